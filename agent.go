@@ -4,21 +4,40 @@ package ssh2
 #cgo pkg-config: libssh2
 #include <libssh2.h>
 #include <stdlib.h>
+
+extern void goAuthAgent(LIBSSH2_SESSION *session, LIBSSH2_CHANNEL *channel, void **abstract);
 */
 import "C"
 
 import (
+	"context"
+	"crypto"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"iter"
+	"net"
+	"os"
+	"slices"
+	"sync"
 	"unsafe"
 )
 
 type Agent struct {
-	ptr *C.LIBSSH2_AGENT
+	parent *SshSession
+	ptr    *C.LIBSSH2_AGENT
+	// Socket of the agent, as given to Connect.
+	path string
+	// Whether libssh2 is connected to the agent, see signRSA.
+	connected bool
+
+	// Guards the identities libssh2 fetched, which it frees on each listing.
+	mu sync.Mutex
 }
 
 func (ss *SshSession) AgentInit() (*Agent, error) {
-	agent := &Agent{}
+	agent := &Agent{parent: ss}
 	agent.ptr = C.libssh2_agent_init(ss.ptr)
 
 	if agent.ptr == nil {
@@ -28,12 +47,16 @@ func (ss *SshSession) AgentInit() (*Agent, error) {
 	return agent, nil
 }
 
-func (ss *Agent) Free() {
-	C.libssh2_agent_free(ss.ptr)
+func (a *Agent) Free() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	C.libssh2_agent_free(a.ptr)
 }
 
 // Connect to the agent running at path, if it's empty uses $SSH_AUTH_SOCK
 func (a *Agent) Connect(path string) error {
+	a.path = path
 	if len(path) > 0 {
 		pathnameCStr := C.CString(path)
 		defer C.free(unsafe.Pointer(pathnameCStr))
@@ -41,53 +64,427 @@ func (a *Agent) Connect(path string) error {
 		C.libssh2_agent_set_identity_path(a.ptr, pathnameCStr)
 	}
 
-	return wrapSshError(C.libssh2_agent_connect(a.ptr))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	err := a.parent.check("agent connect", func() C.int {
+		return C.libssh2_agent_connect(a.ptr)
+	})
+	a.connected = err == nil
+	return err
 }
 
 func (a *Agent) Disconnect() error {
-	return wrapSshError(C.libssh2_agent_disconnect(a.ptr))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.connected = false
+	return a.parent.check("agent disconnect", func() C.int {
+		return C.libssh2_agent_disconnect(a.ptr)
+	})
 }
 
+// AgentPublicKey is an identity held by the agent, Blob being the public
+// key in SSH wire encoding.
 type AgentPublicKey struct {
-	blob    string
-	comment string
-	ptr     *C.struct_libssh2_agent_publickey
+	Blob    []byte
+	Comment string
+}
+
+// Type returns the key algorithm, e.g. "ssh-ed25519".
+func (apk *AgentPublicKey) Type() string {
+	keyType, _, ok := readString(apk.Blob)
+	if !ok {
+		return ""
+	}
+
+	return string(keyType)
 }
 
-// List identities. Note that it's fine to hold references to the yielded
-// AgentPublicKey, they are only freed when calling Agent.Free()
+// Fingerprint returns the SHA256 fingerprint of the key as shown by
+// ssh-add -l.
+func (apk *AgentPublicKey) Fingerprint() string {
+	return fingerprintSHA256(apk.Blob)
+}
+
+// ListIdentities fetches the identities of the agent. The yielded values
+// stay valid after later listings and after the agent lets go of the key,
+// using one it no longer holds fails.
 func (a *Agent) ListIdentities() (iter.Seq2[*AgentPublicKey, error], error) {
-	rc := C.libssh2_agent_list_identities(a.ptr)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.list(); err != nil {
+		return nil, err
+	}
 
-	if rc < 0 {
-		return nil, wrapSshError(rc)
+	var identities []*AgentPublicKey
+	var cur, prev *C.struct_libssh2_agent_publickey
+	for {
+		rc := C.libssh2_agent_get_identity(a.ptr, &cur, prev)
+		if rc < 0 {
+			return nil, wrapSshError(rc)
+		} else if rc == 1 {
+			// End of the identities list.
+			break
+		}
+
+		identities = append(identities, &AgentPublicKey{
+			Blob:    C.GoBytes(unsafe.Pointer(cur.blob), C.int(cur.blob_len)),
+			Comment: C.GoString(cur.comment),
+		})
+		prev = cur
 	}
 
 	return func(yield func(*AgentPublicKey, error) bool) {
-		var cur, prev *C.struct_libssh2_agent_publickey
-		for {
-			rc = C.libssh2_agent_get_identity(a.ptr, &cur, prev)
-
-			if rc < 0 {
-				if !yield(nil, wrapSshError(rc)) {
-					return
-				}
-			} else if rc == 0 {
-				apk := &AgentPublicKey{}
-				if !yield(apk, nil) {
-					return
-				}
-			} else {
-				// End of the identities list, rc == 1
-				break
+		for _, apk := range identities {
+			if !yield(apk, nil) {
+				return
 			}
 		}
 	}, nil
 }
 
+// list has libssh2 fetch the identities anew, a.mu must be held.
+func (a *Agent) list() error {
+	return a.parent.check("agent list identities", func() C.int {
+		return C.libssh2_agent_list_identities(a.ptr)
+	})
+}
+
+// identity returns the identity of libssh2 for the key of apk, a.mu must be
+// held for as long as it's used. They are looked up for each use, as any
+// listing frees the previous ones.
+func (a *Agent) identity(apk *AgentPublicKey) (*C.struct_libssh2_agent_publickey, error) {
+	find := func() *C.struct_libssh2_agent_publickey {
+		var cur, prev *C.struct_libssh2_agent_publickey
+		for C.libssh2_agent_get_identity(a.ptr, &cur, prev) == 0 {
+			if slices.Equal(C.GoBytes(unsafe.Pointer(cur.blob), C.int(cur.blob_len)), apk.Blob) {
+				return cur
+			}
+			prev = cur
+		}
+		return nil
+	}
+
+	if cur := find(); cur != nil {
+		return cur, nil
+	}
+
+	// Not fetched yet, or since added to the agent.
+	if err := a.list(); err != nil {
+		return nil, err
+	}
+
+	if cur := find(); cur != nil {
+		return cur, nil
+	}
+
+	return nil, fmt.Errorf("identity %s %s not in agent", apk.Type(), apk.Fingerprint())
+}
+
+// FindIdentity returns the identity whose comment or fingerprint, SHA256 or
+// MD5, is query.
+func (a *Agent) FindIdentity(query string) (*AgentPublicKey, error) {
+	identities, err := a.ListIdentities()
+	if err != nil {
+		return nil, err
+	}
+
+	for apk, err := range identities {
+		if err != nil {
+			return nil, err
+		}
+
+		if apk.Comment == query || apk.Fingerprint() == query || fingerprintMD5(apk.Blob) == query {
+			return apk, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no agent identity matching %q", query)
+}
+
 func (a *Agent) UserAuth(username string, apk *AgentPublicKey) error {
+	return a.UserAuthContext(context.Background(), username, apk)
+}
+
+func (a *Agent) UserAuthContext(ctx context.Context, username string, apk *AgentPublicKey) error {
 	usernameCStr := C.CString(username)
 	defer C.free(unsafe.Pointer(usernameCStr))
 
-	return wrapSshError(C.libssh2_agent_userauth(a.ptr, usernameCStr, apk.ptr))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	identity, err := a.identity(apk)
+	if err != nil {
+		return err
+	}
+
+	return a.parent.do(ctx, "agent userauth", func() C.int {
+		return C.libssh2_agent_userauth(a.ptr, usernameCStr, identity)
+	})
+}
+
+// Sign signs data with the identity for the signature algorithm algo, the
+// key type if it's empty, or one of "rsa-sha2-256" and "rsa-sha2-512" for an
+// RSA key. The signature is returned in SSH wire format, the algorithm name
+// followed by the signature blob. The private key never leaves the agent.
+//
+// libssh2 1.11.1 and older don't pass the rsa-sha2 variants on to the agent,
+// and reject the ssh-rsa signature it then makes. Those requests are sent
+// to the agent libssh2 is connected to directly.
+func (a *Agent) Sign(apk *AgentPublicKey, algo string, data []byte) ([]byte, error) {
+	return a.SignContext(context.Background(), apk, algo, data)
+}
+
+func (a *Agent) SignContext(ctx context.Context, apk *AgentPublicKey, algo string, data []byte) ([]byte, error) {
+	var flags uint32
+	switch {
+	case algo == "":
+		algo = apk.Type()
+	case algo == apk.Type():
+	case algo == "rsa-sha2-256" && apk.Type() == "ssh-rsa":
+		flags = agentRSASHA256
+	case algo == "rsa-sha2-512" && apk.Type() == "ssh-rsa":
+		flags = agentRSASHA512
+	default:
+		return nil, fmt.Errorf("unsupported signature algorithm %q for key type %s", algo, apk.Type())
+	}
+
+	var sig []byte
+	var err error
+	if flags == 0 {
+		sig, err = a.sign(ctx, apk, algo, data)
+	} else {
+		sig, err = a.signRSA(ctx, apk, algo, flags, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return appendString(appendString(nil, []byte(algo)), sig), nil
+}
+
+// sign has libssh2 sign data with the identity for algo, and returns the
+// signature blob.
+func (a *Agent) sign(ctx context.Context, apk *AgentPublicKey, algo string, data []byte) ([]byte, error) {
+	algoCStr := C.CString(algo)
+	defer C.free(unsafe.Pointer(algoCStr))
+
+	dataCStr := C.CBytes(data)
+	defer C.free(dataCStr)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	identity, err := a.identity(apk)
+	if err != nil {
+		return nil, err
+	}
+
+	var sig *C.uchar
+	var sigLen C.size_t
+	err = a.parent.do(ctx, "agent sign", func() C.int {
+		return C.libssh2_agent_sign(a.ptr, identity, &sig, &sigLen,
+			(*C.uchar)(dataCStr), C.size_t(len(data)), algoCStr, C.uint(len(algo)))
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer C.libssh2_free(a.parent.ptr, unsafe.Pointer(sig))
+
+	return C.GoBytes(unsafe.Pointer(sig), C.int(sigLen)), nil
+}
+
+// signRSA asks the agent for an rsa-sha2 signature of data with flags, and
+// returns the signature blob.
+func (a *Agent) signRSA(ctx context.Context, apk *AgentPublicKey, algo string, flags uint32, data []byte) ([]byte, error) {
+	// Only for identities libssh2 has from the agent, while it's connected
+	// to it: libssh2 keeps the identities past Disconnect.
+	a.mu.Lock()
+	err := fmt.Errorf("agent not connected")
+	if a.connected {
+		_, err = a.identity(apk)
+	}
+	a.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	req := appendString([]byte{agentSignRequest}, apk.Blob)
+	req = appendString(req, data)
+	req = binary.BigEndian.AppendUint32(req, flags)
+
+	resp, err := a.roundTrip(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp[0] != agentSignResponse {
+		return nil, fmt.Errorf("agent refused to sign with %s %s", apk.Type(), apk.Fingerprint())
+	}
+
+	sig, _, ok := readString(resp[1:])
+	if !ok {
+		return nil, fmt.Errorf("malformed agent signature")
+	}
+
+	signedWith, rest, ok := readString(sig)
+	if !ok {
+		return nil, fmt.Errorf("malformed agent signature")
+	}
+
+	if string(signedWith) != algo {
+		return nil, fmt.Errorf("agent signed with %s instead of %s", signedWith, algo)
+	}
+
+	blob, _, ok := readString(rest)
+	if !ok {
+		return nil, fmt.Errorf("malformed agent signature")
+	}
+
+	return blob, nil
+}
+
+// roundTrip sends req to the agent, on a connection of its own, and returns
+// the answer. Both go without the message length.
+func (a *Agent) roundTrip(ctx context.Context, req []byte) ([]byte, error) {
+	path := a.path
+	if path == "" {
+		path = os.Getenv("SSH_AUTH_SOCK")
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(aLongTimeAgo)
+	})
+	defer stop()
+
+	err = writeAgentMessage(conn, req)
+	var resp []byte
+	if err == nil {
+		resp, err = readAgentMessage(conn)
+	}
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	return resp, err
+}
+
+// DataSigner signs whole messages, in SSH wire format.
+type DataSigner interface {
+	Public() crypto.PublicKey
+	SignData(data []byte) ([]byte, error)
+}
+
+// Signer returns a DataSigner signing with the identity for the signature
+// algorithm algo, see Sign.
+//
+// It isn't a crypto.Signer: those sign a digest the caller computed, while
+// the agent only signs whole messages, hashing them itself, and makes SSH
+// signatures instead of the PKCS #1 or ASN.1 ones users of crypto.Signer
+// such as crypto/x509 expect. An adapter taking the message in place of the
+// digest would be accepted wherever a crypto.Signer goes, and sign the wrong
+// thing there.
+func (a *Agent) Signer(apk *AgentPublicKey, algo string) (DataSigner, error) {
+	pub, err := parsePublicKey(apk.Blob)
+	if err != nil {
+		return nil, err
+	}
+
+	return &agentSigner{agent: a, apk: apk, algo: algo, pub: pub}, nil
+}
+
+type agentSigner struct {
+	agent *Agent
+	apk   *AgentPublicKey
+	algo  string
+	pub   crypto.PublicKey
+}
+
+func (s *agentSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *agentSigner) SignData(data []byte) ([]byte, error) {
+	return s.agent.Sign(s.apk, s.algo, data)
+}
+
+// UserAuthAny tries every identity of the agent in turn until one is
+// accepted.
+func (a *Agent) UserAuthAny(username string) error {
+	return a.UserAuthAnyContext(context.Background(), username)
+}
+
+func (a *Agent) UserAuthAnyContext(ctx context.Context, username string) error {
+	identities, err := a.ListIdentities()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for apk, err := range identities {
+		if err == nil {
+			err = a.UserAuthContext(ctx, username, apk)
+		}
+
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+
+		errs = append(errs, fmt.Errorf("%s %s: %w", apk.Type(), apk.Fingerprint(), err))
+	}
+
+	if len(errs) == 0 {
+		return fmt.Errorf("no identity in agent")
+	}
+
+	return errors.Join(errs...)
+}
+
+// ForwardAgent relays the agent channels the server opens, following
+// Channel.RequestAgentForwarding, to the agent listening at path, or
+// $SSH_AUTH_SOCK if it's empty. They are only noticed while the session is
+// in use, which is the case while waiting on the output of a command.
+func (ss *SshSession) ForwardAgent(path string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.forwardAgent = &path
+	C.libssh2_session_callback_set2(ss.ptr, C.LIBSSH2_CALLBACK_AUTHAGENT, (*C.libssh2_cb_generic)(C.goAuthAgent))
+}
+
+// relayAgent pumps data between ch, an agent channel opened by the server,
+// and a new connection to the agent at path.
+func (ss *SshSession) relayAgent(ch *Channel, path string) {
+	defer ss.relays.Done()
+	defer ch.Close()
+
+	if path == "" {
+		path = os.Getenv("SSH_AUTH_SOCK")
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		io.Copy(ch, conn)
+		ch.CloseWrite()
+	}()
+
+	io.Copy(conn, ch)
+	conn.Close()
+	<-done
 }
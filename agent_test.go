@@ -0,0 +1,227 @@
+package ssh2
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// startTestAgent serves s on a Unix socket and returns its path.
+func startTestAgent(t *testing.T, s *AgentServer) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go s.Serve(l)
+
+	return path
+}
+
+// startPublicKeyServer starts an SSH server only letting in the holder of
+// the private key of blob.
+func startPublicKeyServer(t *testing.T, blob []byte) string {
+	t.Helper()
+
+	return startTestServer(t, &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), blob) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}, nil)
+}
+
+func TestAgentUserAuth(t *testing.T) {
+	signers := testSigners(t)
+	s := NewAgentServer()
+	for keyType, signer := range signers {
+		if err := s.Add(signer, keyType); err != nil {
+			t.Fatal(err)
+		}
+	}
+	agentPath := startTestAgent(t, s)
+
+	accepted, _, err := marshalPublicKey(signers["ssh-ed25519"].Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startPublicKeyServer(t, accepted)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ss, err := SessionInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+
+	if err := ss.Handshake(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	agent, err := ss.AgentInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Free()
+
+	if err := agent.Connect(agentPath); err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Disconnect()
+
+	identities, err := agent.ListIdentities()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listed := map[string]*AgentPublicKey{}
+	for apk, err := range identities {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if apk.Type() != apk.Comment {
+			t.Errorf("identity of type %s listed with comment %q", apk.Type(), apk.Comment)
+		}
+		listed[apk.Comment] = apk
+	}
+	if len(listed) != len(signers) {
+		t.Fatalf("listed %d identities, want %d", len(listed), len(signers))
+	}
+
+	if err := agent.UserAuth("test", listed["ecdsa-sha2-nistp256"]); err == nil {
+		t.Fatal("authenticating with a key the server doesn't accept succeeded")
+	}
+
+	if err := agent.UserAuth("test", listed["ssh-ed25519"]); err != nil {
+		t.Fatal(err)
+	}
+	if !ss.Authenticated() {
+		t.Error("session not authenticated")
+	}
+}
+
+func TestAgentIdentitiesAuth(t *testing.T) {
+	signers := testSigners(t)
+	s := NewAgentServer()
+	for keyType, signer := range signers {
+		if err := s.Add(signer, keyType); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	accepted, _, err := marshalPublicKey(signers["ssh-rsa"].Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := Dial(ctx, "tcp", startPublicKeyServer(t, accepted), &ClientConfig{
+		User:            "test",
+		Auth:            []AuthMethod{AgentIdentities(startTestAgent(t, s))},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+}
+
+func TestAgentSign(t *testing.T) {
+	signers := testSigners(t)
+	s := NewAgentServer()
+	for keyType, signer := range signers {
+		if err := s.Add(signer, keyType); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ss, err := SessionInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+
+	agent, err := ss.AgentInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Free()
+
+	if err := agent.Connect(startTestAgent(t, s)); err != nil {
+		t.Fatal(err)
+	}
+
+	identities, err := agent.ListIdentities()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("backup manifest")
+	var listed []*AgentPublicKey
+	for apk, err := range identities {
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed = append(listed, apk)
+
+		algos := []string{"", apk.Type()}
+		if apk.Type() == "ssh-rsa" {
+			algos = append(algos, "rsa-sha2-256", "rsa-sha2-512")
+		}
+
+		for _, algo := range algos {
+			sig, err := agent.Sign(apk, algo, data)
+			if err != nil {
+				t.Errorf("%s %q: %v", apk.Type(), algo, err)
+				continue
+			}
+
+			signedWith, rest, _ := readString(sig)
+			blob, _, _ := readString(rest)
+			if want := cmp.Or(algo, apk.Type()); string(signedWith) != want {
+				t.Errorf("%s %q: signed with %s", apk.Type(), algo, signedWith)
+			} else if err := verify(signers[apk.Comment].Public(), want, data, blob); err != nil {
+				t.Errorf("%s %q: %v", apk.Type(), algo, err)
+			}
+		}
+	}
+
+	if _, err := agent.Sign(listed[0], "rsa-sha2-384", data); err == nil {
+		t.Error("signing with an unsupported algorithm succeeded")
+	}
+
+	if err := agent.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	for _, apk := range listed {
+		algo := apk.Type()
+		if algo == "ssh-rsa" {
+			algo = "rsa-sha2-256"
+		}
+
+		if _, err := agent.Sign(apk, algo, data); err == nil {
+			t.Errorf("%s: signing after Disconnect succeeded", algo)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package ssh2
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"slices"
+	"sync"
+)
+
+// Agent protocol messages, see draft-miller-ssh-agent.
+const (
+	agentFailure             = 5
+	agentSuccess             = 6
+	agentRequestIdentities   = 11
+	agentIdentitiesAnswer    = 12
+	agentSignRequest         = 13
+	agentSignResponse        = 14
+	agentAddIdentity         = 17
+	agentRemoveIdentity      = 18
+	agentRemoveAllIdentities = 19
+
+	agentRSASHA256 = 2
+	agentRSASHA512 = 4
+
+	// Far more than any sane request, OpenSSH uses the same limit.
+	agentMaxMessage = 256 * 1024
+)
+
+// AgentServer is an SSH agent holding its keys in memory, for tests and
+// short-lived keys. Serve it on a Unix socket and point Agent.Connect at the
+// socket. It supports listing keys, signing, and adding and removing keys,
+// both through its methods and from clients. Key constraints aren't.
+type AgentServer struct {
+	mu   sync.Mutex
+	keys []agentKey
+}
+
+type agentKey struct {
+	signer  crypto.Signer
+	blob    []byte
+	comment string
+}
+
+func NewAgentServer() *AgentServer {
+	return &AgentServer{}
+}
+
+// Add adds an RSA, ECDSA or Ed25519 key, replacing the comment of the key
+// if it's already there.
+func (s *AgentServer) Add(signer crypto.Signer, comment string) error {
+	blob, _, err := marshalPublicKey(signer.Public())
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if i := s.index(blob); i >= 0 {
+		s.keys[i].comment = comment
+		return nil
+	}
+
+	s.keys = append(s.keys, agentKey{signer: signer, blob: blob, comment: comment})
+	return nil
+}
+
+// Remove removes the key of pub.
+func (s *AgentServer) Remove(pub crypto.PublicKey) error {
+	blob, _, err := marshalPublicKey(pub)
+	if err != nil {
+		return err
+	}
+
+	if !s.remove(blob) {
+		return fmt.Errorf("key not found in agent")
+	}
+
+	return nil
+}
+
+// RemoveAll removes every key.
+func (s *AgentServer) RemoveAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys = nil
+}
+
+// Serve serves each connection accepted on l in its own goroutine, until l
+// is closed.
+func (s *AgentServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn answers the requests read from conn until the client goes away,
+// then closes conn.
+func (s *AgentServer) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+
+	for {
+		req, err := readAgentMessage(conn)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := writeAgentMessage(conn, s.handle(req)); err != nil {
+			return err
+		}
+	}
+}
+
+// readAgentMessage reads a message from r, and returns it without its
+// length.
+func readAgentMessage(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(header[:])
+	if n == 0 || n > agentMaxMessage {
+		return nil, fmt.Errorf("invalid agent message length %d", n)
+	}
+
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// writeAgentMessage writes msg to w, preceded by its length.
+func writeAgentMessage(w io.Writer, msg []byte) error {
+	_, err := w.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(msg))), msg...))
+	return err
+}
+
+// handle returns the answer to req, the message length aside.
+func (s *AgentServer) handle(req []byte) []byte {
+	failure := []byte{agentFailure}
+	success := []byte{agentSuccess}
+
+	switch req[0] {
+	case agentRequestIdentities:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		resp := binary.BigEndian.AppendUint32([]byte{agentIdentitiesAnswer}, uint32(len(s.keys)))
+		for _, key := range s.keys {
+			resp = appendString(resp, key.blob)
+			resp = appendString(resp, []byte(key.comment))
+		}
+		return resp
+
+	case agentSignRequest:
+		blob, rest, ok := readString(req[1:])
+		if !ok {
+			return failure
+		}
+
+		data, rest, ok := readString(rest)
+		if !ok || len(rest) != 4 {
+			return failure
+		}
+		flags := binary.BigEndian.Uint32(rest)
+
+		sig, err := s.sign(blob, data, flags)
+		if err != nil {
+			return failure
+		}
+		return appendString([]byte{agentSignResponse}, sig)
+
+	case agentAddIdentity:
+		signer, comment, err := parseAgentKey(req[1:])
+		if err != nil {
+			return failure
+		}
+
+		if err := s.Add(signer, comment); err != nil {
+			return failure
+		}
+		return success
+
+	case agentRemoveIdentity:
+		blob, _, ok := readString(req[1:])
+		if !ok || !s.remove(blob) {
+			return failure
+		}
+		return success
+
+	case agentRemoveAllIdentities:
+		s.RemoveAll()
+		return success
+
+	default:
+		return failure
+	}
+}
+
+// sign returns the signature of data by the key of blob, in SSH wire format.
+func (s *AgentServer) sign(blob, data []byte, flags uint32) ([]byte, error) {
+	s.mu.Lock()
+	i := s.index(blob)
+	if i < 0 {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("key not found in agent")
+	}
+	signer := s.keys[i].signer
+	s.mu.Unlock()
+
+	algo, _, _ := readString(blob)
+	if bytes.Equal(algo, []byte("ssh-rsa")) {
+		switch {
+		case flags&agentRSASHA512 != 0:
+			algo = []byte("rsa-sha2-512")
+		case flags&agentRSASHA256 != 0:
+			algo = []byte("rsa-sha2-256")
+		}
+	}
+
+	sig, err := sign(signer, string(algo), data)
+	if err != nil {
+		return nil, err
+	}
+
+	return appendString(appendString(nil, algo), sig), nil
+}
+
+// index returns the index of the key of blob or -1, s.mu must be held.
+func (s *AgentServer) index(blob []byte) int {
+	return slices.IndexFunc(s.keys, func(key agentKey) bool {
+		return bytes.Equal(key.blob, blob)
+	})
+}
+
+func (s *AgentServer) remove(blob []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.index(blob)
+	if i < 0 {
+		return false
+	}
+
+	s.keys = slices.Delete(s.keys, i, i+1)
+	return true
+}
+
+// parseAgentKey parses the private key and comment of an add identity
+// request.
+func parseAgentKey(b []byte) (crypto.Signer, string, error) {
+	keyType, rest, ok := readString(b)
+	if !ok {
+		return nil, "", fmt.Errorf("malformed agent key")
+	}
+
+	var signer crypto.Signer
+	switch string(keyType) {
+	case "ssh-rsa":
+		var n, e, d, iqmp, p, q *big.Int
+		for _, field := range []**big.Int{&n, &e, &d, &iqmp, &p, &q} {
+			if *field, rest, ok = readMpint(rest); !ok {
+				return nil, "", fmt.Errorf("malformed RSA agent key")
+			}
+		}
+
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, "", fmt.Errorf("malformed RSA agent key")
+		}
+
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+		if err := key.Validate(); err != nil {
+			return nil, "", err
+		}
+		key.Precompute()
+		signer = key
+
+	case "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521":
+		// The public part is laid out like the public key blob.
+		_, afterCurve, ok := readString(rest)
+		if !ok {
+			return nil, "", fmt.Errorf("malformed ECDSA agent key")
+		}
+
+		_, afterPoint, ok := readString(afterCurve)
+		if !ok {
+			return nil, "", fmt.Errorf("malformed ECDSA agent key")
+		}
+
+		pub, err := parsePublicKey(b[:len(b)-len(afterPoint)])
+		if err != nil {
+			return nil, "", err
+		}
+
+		var d *big.Int
+		if d, rest, ok = readMpint(afterPoint); !ok {
+			return nil, "", fmt.Errorf("malformed ECDSA agent key")
+		}
+
+		key := &ecdsa.PrivateKey{PublicKey: *pub.(*ecdsa.PublicKey), D: d}
+		ecdhKey, err := key.ECDH()
+		if err != nil {
+			return nil, "", err
+		}
+
+		point, _, _ := readString(afterCurve)
+		if !bytes.Equal(ecdhKey.PublicKey().Bytes(), point) {
+			return nil, "", fmt.Errorf("malformed ECDSA agent key")
+		}
+		signer = key
+
+	case "ssh-ed25519":
+		var pub, priv []byte
+		if pub, rest, ok = readString(rest); !ok || len(pub) != ed25519.PublicKeySize {
+			return nil, "", fmt.Errorf("malformed Ed25519 agent key")
+		}
+
+		if priv, rest, ok = readString(rest); !ok || len(priv) != ed25519.PrivateKeySize {
+			return nil, "", fmt.Errorf("malformed Ed25519 agent key")
+		}
+
+		key := ed25519.NewKeyFromSeed(priv[:ed25519.SeedSize])
+		if !bytes.Equal(key.Public().(ed25519.PublicKey), pub) {
+			return nil, "", fmt.Errorf("malformed Ed25519 agent key")
+		}
+		signer = key
+
+	default:
+		return nil, "", fmt.Errorf("unsupported agent key type %q", keyType)
+	}
+
+	comment, _, ok := readString(rest)
+	if !ok {
+		return nil, "", fmt.Errorf("malformed agent key")
+	}
+
+	return signer, string(comment), nil
+}
@@ -0,0 +1,297 @@
+package ssh2
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+)
+
+// agentClient speaks the agent protocol to an AgentServer over a pipe.
+type agentClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func newAgentClient(t *testing.T, s *AgentServer) *agentClient {
+	client, server := net.Pipe()
+	go s.ServeConn(server)
+	t.Cleanup(func() { client.Close() })
+
+	return &agentClient{t: t, conn: client}
+}
+
+// call sends req and returns the answer, both without the message length.
+func (c *agentClient) call(req ...byte) []byte {
+	c.t.Helper()
+
+	msg := binary.BigEndian.AppendUint32(nil, uint32(len(req)))
+	if _, err := c.conn.Write(append(msg, req...)); err != nil {
+		c.t.Fatal(err)
+	}
+
+	var header [4]byte
+	if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+		c.t.Fatal(err)
+	}
+
+	resp := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(c.conn, resp); err != nil {
+		c.t.Fatal(err)
+	}
+
+	return resp
+}
+
+type listedKey struct {
+	blob    []byte
+	comment string
+}
+
+func (c *agentClient) list() []listedKey {
+	c.t.Helper()
+
+	resp := c.call(agentRequestIdentities)
+	if len(resp) < 5 || resp[0] != agentIdentitiesAnswer {
+		c.t.Fatalf("unexpected identities answer %x", resp)
+	}
+
+	var keys []listedKey
+	rest := resp[5:]
+	for range binary.BigEndian.Uint32(resp[1:5]) {
+		var blob, comment []byte
+		var ok bool
+		if blob, rest, ok = readString(rest); !ok {
+			c.t.Fatal("malformed identities answer")
+		}
+		if comment, rest, ok = readString(rest); !ok {
+			c.t.Fatal("malformed identities answer")
+		}
+		keys = append(keys, listedKey{blob: blob, comment: string(comment)})
+	}
+
+	return keys
+}
+
+// sign returns the algorithm name and blob of the signature of data.
+func (c *agentClient) sign(blob, data []byte, flags uint32) (string, []byte) {
+	c.t.Helper()
+
+	req := appendString([]byte{agentSignRequest}, blob)
+	req = appendString(req, data)
+	req = binary.BigEndian.AppendUint32(req, flags)
+
+	resp := c.call(req...)
+	if resp[0] != agentSignResponse {
+		c.t.Fatalf("sign answer %d, want %d", resp[0], agentSignResponse)
+	}
+
+	sig, _, ok := readString(resp[1:])
+	if !ok {
+		c.t.Fatal("malformed sign answer")
+	}
+
+	algo, rest, ok := readString(sig)
+	if !ok {
+		c.t.Fatal("malformed signature")
+	}
+
+	sigBlob, _, ok := readString(rest)
+	if !ok {
+		c.t.Fatal("malformed signature")
+	}
+
+	return string(algo), sigBlob
+}
+
+// addRequest returns the message adding key to the agent, as ssh-add sends
+// it.
+func addRequest(t *testing.T, key crypto.Signer, comment string) []byte {
+	t.Helper()
+
+	blob, keyType, err := marshalPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := appendString([]byte{agentAddIdentity}, []byte(keyType))
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		for _, n := range []*big.Int{key.N, big.NewInt(int64(key.E)), key.D, key.Precomputed.Qinv, key.Primes[0], key.Primes[1]} {
+			req = appendMpint(req, n)
+		}
+
+	case *ecdsa.PrivateKey:
+		// The curve name and point, as in the public key blob.
+		_, rest, _ := readString(blob)
+		req = append(req, rest...)
+		req = appendMpint(req, key.D)
+
+	case ed25519.PrivateKey:
+		req = appendString(req, key.Public().(ed25519.PublicKey))
+		req = appendString(req, key)
+	}
+
+	return appendString(req, []byte(comment))
+}
+
+func TestAgentServerSign(t *testing.T) {
+	s := NewAgentServer()
+	c := newAgentClient(t, s)
+	data := []byte("backup manifest")
+
+	for keyType, signer := range testSigners(t) {
+		if err := s.Add(signer, keyType); err != nil {
+			t.Fatal(err)
+		}
+
+		blob, _, err := marshalPublicKey(signer.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		flags := map[uint32]string{0: keyType}
+		if keyType == "ssh-rsa" {
+			flags[agentRSASHA256] = "rsa-sha2-256"
+			flags[agentRSASHA512] = "rsa-sha2-512"
+		}
+
+		for flag, want := range flags {
+			algo, sig := c.sign(blob, data, flag)
+			if algo != want {
+				t.Errorf("%s: signed with %q for flags %d, want %q", keyType, algo, flag, want)
+			}
+
+			if err := verify(signer.Public(), algo, data, sig); err != nil {
+				t.Errorf("%s %s: %v", keyType, algo, err)
+			}
+		}
+	}
+
+	if got := len(c.list()); got != 5 {
+		t.Errorf("listed %d keys, want 5", got)
+	}
+}
+
+func TestAgentServerAddRemove(t *testing.T) {
+	s := NewAgentServer()
+	c := newAgentClient(t, s)
+	signers := testSigners(t)
+
+	if keys := c.list(); len(keys) != 0 {
+		t.Fatalf("new agent lists %d keys", len(keys))
+	}
+
+	for keyType, signer := range signers {
+		if resp := c.call(addRequest(t, signer, keyType)...); !bytes.Equal(resp, []byte{agentSuccess}) {
+			t.Fatalf("adding %s: answer %x", keyType, resp)
+		}
+	}
+
+	keys := c.list()
+	if len(keys) != len(signers) {
+		t.Fatalf("listed %d keys, want %d", len(keys), len(signers))
+	}
+
+	data := []byte("backup manifest")
+	for _, key := range keys {
+		signer := signers[key.comment]
+		if signer == nil {
+			t.Fatalf("unexpected comment %q", key.comment)
+		}
+
+		pub, err := parsePublicKey(key.blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !signer.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(pub) {
+			t.Errorf("%s: listed key differs from the added one", key.comment)
+		}
+
+		// The key made it through intact if it signs right.
+		algo, sig := c.sign(key.blob, data, 0)
+		if err := verify(pub, algo, data, sig); err != nil {
+			t.Errorf("%s: %v", key.comment, err)
+		}
+	}
+
+	remove := appendString([]byte{agentRemoveIdentity}, keys[0].blob)
+	if resp := c.call(remove...); !bytes.Equal(resp, []byte{agentSuccess}) {
+		t.Errorf("removing a key: answer %x", resp)
+	}
+	if resp := c.call(remove...); !bytes.Equal(resp, []byte{agentFailure}) {
+		t.Errorf("removing a removed key: answer %x", resp)
+	}
+	if got := len(c.list()); got != len(signers)-1 {
+		t.Errorf("listed %d keys after removal, want %d", got, len(signers)-1)
+	}
+
+	if resp := c.call(agentRemoveAllIdentities); !bytes.Equal(resp, []byte{agentSuccess}) {
+		t.Errorf("removing all keys: answer %x", resp)
+	}
+	if got := len(c.list()); got != 0 {
+		t.Errorf("listed %d keys after removing all", got)
+	}
+}
+
+func TestAgentServerAddReplacesComment(t *testing.T) {
+	s := NewAgentServer()
+	c := newAgentClient(t, s)
+	signer := testSigners(t)["ssh-ed25519"]
+
+	s.Add(signer, "old")
+	s.Add(signer, "new")
+
+	keys := c.list()
+	if len(keys) != 1 || keys[0].comment != "new" {
+		t.Errorf("listed %+v, want a single key commented \"new\"", keys)
+	}
+
+	if err := s.Remove(signer.Public()); err != nil {
+		t.Error(err)
+	}
+	if err := s.Remove(signer.Public()); err == nil {
+		t.Error("removing a removed key succeeded")
+	}
+}
+
+func TestAgentServerFailures(t *testing.T) {
+	s := NewAgentServer()
+	c := newAgentClient(t, s)
+	signers := testSigners(t)
+
+	blob, _, err := marshalPublicKey(signers["ssh-ed25519"].Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unknownKey := appendString([]byte{agentSignRequest}, blob)
+	unknownKey = appendString(unknownKey, []byte("data"))
+	unknownKey = binary.BigEndian.AppendUint32(unknownKey, 0)
+
+	// A private key not matching its public half must be refused, the seed
+	// starts 64 bytes before the empty comment.
+	bad := addRequest(t, signers["ssh-ed25519"], "")
+	bad[len(bad)-4-64] ^= 1
+
+	for name, req := range map[string][]byte{
+		"unknown message":   {42},
+		"sign unknown key":  unknownKey,
+		"truncated sign":    unknownKey[:len(unknownKey)-2],
+		"unsupported key":   appendString([]byte{agentAddIdentity}, []byte("ssh-dss")),
+		"mismatched key":    bad,
+		"truncated add":     addRequest(t, signers["ssh-rsa"], "")[:100],
+		"remove unknown":    appendString([]byte{agentRemoveIdentity}, blob),
+		"malformed removal": {agentRemoveIdentity, 0, 0},
+	} {
+		if resp := c.call(req...); !bytes.Equal(resp, []byte{agentFailure}) {
+			t.Errorf("%s: answer %x, want failure", name, resp)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package ssh2
+
+/*
+#include <libssh2.h>
+*/
+import "C"
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// AuthMethod is a way to authenticate the user, see Password or
+// PublicKeyFile for instance.
+type AuthMethod interface {
+	// Method is the name servers advertise the method with, e.g. "password".
+	Method() string
+
+	authenticate(ctx context.Context, ss *SshSession, username string) error
+}
+
+type passwordAuth string
+
+// Password authenticates with the given password.
+func Password(password string) AuthMethod {
+	return passwordAuth(password)
+}
+
+func (passwordAuth) Method() string {
+	return "password"
+}
+
+func (pw passwordAuth) authenticate(ctx context.Context, ss *SshSession, username string) error {
+	return ss.UserAuthPasswordContext(ctx, username, string(pw))
+}
+
+type passwordChangeAuth struct {
+	password    string
+	newPassword PasswordChangeCallback
+}
+
+// PasswordChange authenticates with the given password and renews it with
+// newPassword if it expired, see SshSession.UserAuthPasswordChange.
+func PasswordChange(password string, newPassword PasswordChangeCallback) AuthMethod {
+	return &passwordChangeAuth{password, newPassword}
+}
+
+func (*passwordChangeAuth) Method() string {
+	return "password"
+}
+
+func (pc *passwordChangeAuth) authenticate(ctx context.Context, ss *SshSession, username string) error {
+	return ss.UserAuthPasswordChangeContext(ctx, username, pc.password, pc.newPassword)
+}
+
+type publicKeyFileAuth struct {
+	publicKeyPath, privateKeyPath, passphrase string
+}
+
+// PublicKeyFile authenticates with a key file, see
+// SshSession.UserAuthPublicKeyFromFile.
+func PublicKeyFile(publicKeyPath, privateKeyPath, passphrase string) AuthMethod {
+	return &publicKeyFileAuth{publicKeyPath, privateKeyPath, passphrase}
+}
+
+func (*publicKeyFileAuth) Method() string {
+	return "publickey"
+}
+
+func (pk *publicKeyFileAuth) authenticate(ctx context.Context, ss *SshSession, username string) error {
+	return ss.UserAuthPublicKeyFromFileContext(ctx, username, pk.publicKeyPath, pk.privateKeyPath, pk.passphrase)
+}
+
+type publicKeyAuth struct {
+	publicKey, privateKey []byte
+	passphrase            string
+}
+
+// PublicKey authenticates with a key held in memory, see
+// SshSession.UserAuthPublicKeyFromMemory.
+func PublicKey(publicKey, privateKey []byte, passphrase string) AuthMethod {
+	return &publicKeyAuth{publicKey, privateKey, passphrase}
+}
+
+func (*publicKeyAuth) Method() string {
+	return "publickey"
+}
+
+func (pk *publicKeyAuth) authenticate(ctx context.Context, ss *SshSession, username string) error {
+	return ss.UserAuthPublicKeyFromMemoryContext(ctx, username, pk.publicKey, pk.privateKey, pk.passphrase)
+}
+
+type signerAuth struct {
+	signer crypto.Signer
+}
+
+// PublicKeySigner authenticates with the key behind signer, see
+// SshSession.UserAuthPublicKeySigner.
+func PublicKeySigner(signer crypto.Signer) AuthMethod {
+	return &signerAuth{signer}
+}
+
+func (*signerAuth) Method() string {
+	return "publickey"
+}
+
+func (sa *signerAuth) authenticate(ctx context.Context, ss *SshSession, username string) error {
+	return ss.UserAuthPublicKeySignerContext(ctx, username, sa.signer)
+}
+
+type hostbasedFileAuth struct {
+	publicKeyPath, privateKeyPath, passphrase, hostname, localUsername string
+}
+
+// HostbasedFile authenticates as localUsername on the local host hostname,
+// see SshSession.UserAuthHostbasedFromFile.
+func HostbasedFile(publicKeyPath, privateKeyPath, passphrase, hostname, localUsername string) AuthMethod {
+	return &hostbasedFileAuth{publicKeyPath, privateKeyPath, passphrase, hostname, localUsername}
+}
+
+func (*hostbasedFileAuth) Method() string {
+	return "hostbased"
+}
+
+func (hb *hostbasedFileAuth) authenticate(ctx context.Context, ss *SshSession, username string) error {
+	return ss.UserAuthHostbasedFromFileContext(ctx, username, hb.publicKeyPath, hb.privateKeyPath, hb.passphrase,
+		hb.hostname, hb.localUsername)
+}
+
+type keyboardInteractiveAuth KeyboardInteractiveChallenge
+
+// KeyboardInteractive authenticates by answering the server's prompts with
+// challenge, see SshSession.UserAuthKeyboardInteractive.
+func KeyboardInteractive(challenge KeyboardInteractiveChallenge) AuthMethod {
+	return keyboardInteractiveAuth(challenge)
+}
+
+func (keyboardInteractiveAuth) Method() string {
+	return "keyboard-interactive"
+}
+
+func (ki keyboardInteractiveAuth) authenticate(ctx context.Context, ss *SshSession, username string) error {
+	return ss.UserAuthKeyboardInteractiveContext(ctx, username, KeyboardInteractiveChallenge(ki))
+}
+
+type agentAuth string
+
+// AgentIdentities tries every identity of the agent listening at path, or
+// $SSH_AUTH_SOCK if it's empty.
+func AgentIdentities(path string) AuthMethod {
+	return agentAuth(path)
+}
+
+func (agentAuth) Method() string {
+	return "publickey"
+}
+
+func (path agentAuth) authenticate(ctx context.Context, ss *SshSession, username string) error {
+	agent, err := ss.AgentInit()
+	if err != nil {
+		return err
+	}
+	defer agent.Free()
+
+	if err := agent.Connect(string(path)); err != nil {
+		return err
+	}
+	defer agent.Disconnect()
+
+	return agent.UserAuthAnyContext(ctx, username)
+}
+
+var errNotOffered = errors.New("not offered by the server")
+
+// AuthAttempt is the outcome of an authentication method.
+type AuthAttempt struct {
+	Method string
+	// The server accepted the method but requires another one.
+	Partial bool
+	Err     error
+}
+
+// AuthError is returned when authentication failed, it details every
+// method attempted in order.
+type AuthError struct {
+	Username string
+	Attempts []AuthAttempt
+}
+
+func (e *AuthError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "failed to authenticate %q", e.Username)
+
+	if len(e.Attempts) == 0 {
+		b.WriteString(": no method to try")
+	}
+
+	for i, attempt := range e.Attempts {
+		if i == 0 {
+			b.WriteString(": ")
+		} else {
+			b.WriteString("; ")
+		}
+
+		b.WriteString(attempt.Method)
+		if attempt.Partial {
+			b.WriteString(": partial success")
+		} else if attempt.Err != nil {
+			b.WriteString(": " + attempt.Err.Error())
+		}
+	}
+
+	return b.String()
+}
+
+func (e *AuthError) Unwrap() []error {
+	var errs []error
+	for _, attempt := range e.Attempts {
+		if attempt.Err != nil {
+			errs = append(errs, attempt.Err)
+		}
+	}
+
+	return errs
+}
+
+// Authenticated reports whether the session completed authentication.
+func (ss *SshSession) Authenticated() bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	return C.libssh2_userauth_authenticated(ss.ptr) != 0
+}
+
+// Authenticate tries methods until the session is authenticated, each at
+// most once and in order among those the server offers at the time. Servers
+// requiring several methods, e.g. a password then an OTP, are handled: the
+// offered methods are refreshed after each attempt, so a method the server
+// only offers after a partial success is still tried. On failure, the error
+// is an *AuthError.
+func (ss *SshSession) Authenticate(username string, methods ...AuthMethod) error {
+	return ss.AuthenticateContext(context.Background(), username, methods...)
+}
+
+func (ss *SshSession) AuthenticateContext(ctx context.Context, username string, methods ...AuthMethod) error {
+	authErr := &AuthError{Username: username}
+
+	offered, err := ss.offeredMethods(ctx, username)
+	if err != nil {
+		authErr.Attempts = append(authErr.Attempts, AuthAttempt{Method: "none", Err: err})
+		return authErr
+	} else if ss.Authenticated() {
+		return nil
+	}
+
+	tried := make([]bool, len(methods))
+	next := func() int {
+		for i, method := range methods {
+			if !tried[i] && slices.Contains(offered, method.Method()) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	for i := next(); i >= 0; i = next() {
+		method := methods[i]
+		tried[i] = true
+
+		err := method.authenticate(ctx, ss, username)
+		if ss.Authenticated() {
+			return nil
+		}
+
+		attempt := AuthAttempt{Method: method.Method(), Err: err}
+		if err != nil && ctx.Err() != nil {
+			authErr.Attempts = append(authErr.Attempts, attempt)
+			return authErr
+		}
+
+		// libssh2 doesn't report partial success, but the method is no
+		// longer offered then.
+		offered, err = ss.offeredMethods(ctx, username)
+		if err != nil {
+			authErr.Attempts = append(authErr.Attempts, attempt, AuthAttempt{Method: "none", Err: err})
+			return authErr
+		}
+
+		if len(offered) > 0 && !slices.Contains(offered, method.Method()) {
+			attempt.Partial, attempt.Err = true, nil
+		}
+		authErr.Attempts = append(authErr.Attempts, attempt)
+	}
+
+	for i, method := range methods {
+		if !tried[i] {
+			authErr.Attempts = append(authErr.Attempts, AuthAttempt{Method: method.Method(), Err: errNotOffered})
+		}
+	}
+
+	return authErr
+}
+
+// offeredMethods returns the methods the server offers to authenticate
+// username, the list is empty if none is needed.
+func (ss *SshSession) offeredMethods(ctx context.Context, username string) ([]string, error) {
+	list, err := ss.UserAuthListContext(ctx, username)
+	if err != nil {
+		if ss.Authenticated() {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return strings.Split(list, ","), nil
+}
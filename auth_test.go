@@ -0,0 +1,50 @@
+package ssh2
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAuthenticateListingFails(t *testing.T) {
+	addr := startTestServer(t, &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}, nil)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ss, err := SessionInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+
+	if err := ss.Handshake(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = ss.AuthenticateContext(ctx, "test", Password("test"))
+
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("AuthenticateContext() = %v, want an *AuthError", err)
+	}
+	if len(authErr.Attempts) != 1 || authErr.Attempts[0].Method != "none" {
+		t.Errorf("attempts %+v, want a single none attempt", authErr.Attempts)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("AuthenticateContext() = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,75 @@
+package ssh2
+
+// Go functions called back by libssh2. As they are exported, the preamble of
+// this file may only contain declarations.
+
+/*
+#include <libssh2.h>
+*/
+import "C"
+
+import (
+	"unsafe"
+)
+
+//export goKbdintResponse
+func goKbdintResponse(name *C.char, nameLen C.int, instruction *C.char, instructionLen C.int,
+	numPrompts C.int, prompts *C.LIBSSH2_USERAUTH_KBDINT_PROMPT, responses *C.LIBSSH2_USERAUTH_KBDINT_RESPONSE,
+	abstract *unsafe.Pointer) {
+	ss := sessionFromAbstract(abstract)
+	if ss.kbdint == nil {
+		return
+	}
+
+	ss.kbdint.respond(C.GoStringN(name, nameLen), C.GoStringN(instruction, instructionLen),
+		unsafe.Slice(prompts, int(numPrompts)), unsafe.Slice(responses, int(numPrompts)))
+}
+
+//export goPasswordChange
+func goPasswordChange(session *C.LIBSSH2_SESSION, newPassword **C.char, newPasswordLen *C.int, abstract *unsafe.Pointer) {
+	ss := sessionFromAbstract(abstract)
+	if ss.passwordChange == nil {
+		return
+	}
+
+	// Leaving it NULL makes libssh2 give up.
+	password, err := ss.passwordChange.newPassword()
+	if err != nil {
+		ss.passwordChange.err = err
+		return
+	}
+
+	// libssh2 frees it.
+	*newPassword = C.CString(password)
+	*newPasswordLen = C.int(len(password))
+}
+
+//export goSign
+func goSign(session *C.LIBSSH2_SESSION, sig **C.uchar, sigLen *C.size_t, data *C.uchar, dataLen C.size_t,
+	abstract *unsafe.Pointer) C.int {
+	ss := sessionFromAbstract(C.libssh2_session_abstract(session))
+	if ss.signer == nil || ss.signer.err != nil {
+		return -1
+	}
+
+	out, err := ss.signer.sign(C.GoBytes(unsafe.Pointer(data), C.int(dataLen)))
+	if err != nil {
+		ss.signer.err = err
+		return -1
+	}
+
+	// libssh2 frees it.
+	*sig = (*C.uchar)(C.CBytes(out))
+	*sigLen = C.size_t(len(out))
+
+	return 0
+}
+
+//export goAuthAgent
+func goAuthAgent(session *C.LIBSSH2_SESSION, channel *C.LIBSSH2_CHANNEL, abstract *unsafe.Pointer) {
+	ss := sessionFromAbstract(abstract)
+
+	// We are within a call holding the session, relay on the side.
+	ss.relays.Add(1)
+	go ss.relayAgent(&Channel{parent: ss, ptr: channel}, *ss.forwardAgent)
+}
@@ -0,0 +1,363 @@
+package ssh2
+
+/*
+#include <libssh2.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Channel is a channel of the session, see OpenChannel. Unlike other calls,
+// reads and writes don't hold the session while they wait even in blocking
+// mode, so any number of channels can be used at once.
+type Channel struct {
+	parent *SshSession
+	ptr    *C.LIBSSH2_CHANNEL
+
+	// Streams handed out by Stdout and Stderr, Wait leaves them to their
+	// readers.
+	stdoutTaken, stderrTaken atomic.Bool
+}
+
+// OpenChannel opens a session channel, to run a command on with Exec.
+func (ss *SshSession) OpenChannel() (*Channel, error) {
+	return ss.OpenChannelContext(context.Background())
+}
+
+func (ss *SshSession) OpenChannelContext(ctx context.Context) (*Channel, error) {
+	channelType := C.CString("session")
+	defer C.free(unsafe.Pointer(channelType))
+
+	ch := &Channel{parent: ss}
+	err := ss.request(ctx, "channel open", func() C.int {
+		ch.ptr = C.libssh2_channel_open_ex(ss.ptr, channelType, C.uint(len("session")),
+			C.LIBSSH2_CHANNEL_WINDOW_DEFAULT, C.LIBSSH2_CHANNEL_PACKET_DEFAULT, nil, 0)
+		if ch.ptr == nil {
+			return C.libssh2_session_last_errno(ss.ptr)
+		}
+		return 0
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ch, nil
+}
+
+// Subsystem opens a channel bound to the subsystem name, e.g. "netconf",
+// whose protocol is then spoken by reading and writing the channel.
+func (ss *SshSession) Subsystem(name string) (*Channel, error) {
+	return ss.SubsystemContext(context.Background(), name)
+}
+
+func (ss *SshSession) SubsystemContext(ctx context.Context, name string) (*Channel, error) {
+	ch, err := ss.OpenChannelContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ch.startup(ctx, "subsystem", name); err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	return ch, nil
+}
+
+// request is stream for channel opens and requests, which must not overlap:
+// libssh2 takes the reply to another channel's request for a failure of its
+// own.
+func (ss *SshSession) request(ctx context.Context, op string, fn func() C.int) error {
+	ss.reqmu.Lock()
+	defer ss.reqmu.Unlock()
+
+	return ss.stream(ctx, op, fn)
+}
+
+// RequestAgentForwarding asks the server to forward the agent to the
+// command run on the channel, which it does by opening channels back to us.
+// They are relayed to the local agent, SshSession.ForwardAgent must have
+// been called first.
+func (ch *Channel) RequestAgentForwarding() error {
+	return ch.parent.request(context.Background(), "channel request auth agent", func() C.int {
+		return C.libssh2_channel_request_auth_agent(ch.ptr)
+	})
+}
+
+// Setenv sets the environment variable name to value for the command or
+// shell started on the channel afterwards. Servers only accept the variables
+// they are configured to, such as those matching AcceptEnv for OpenSSH, a
+// denied one fails with an *Error of code ErrorChannelRequestDenied.
+func (ch *Channel) Setenv(name, value string) error {
+	return ch.SetenvContext(context.Background(), name, value)
+}
+
+func (ch *Channel) SetenvContext(ctx context.Context, name, value string) error {
+	nameCStr := C.CString(name)
+	defer C.free(unsafe.Pointer(nameCStr))
+
+	valueCStr := C.CString(value)
+	defer C.free(unsafe.Pointer(valueCStr))
+
+	return ch.parent.request(ctx, "channel setenv "+name, func() C.int {
+		return C.libssh2_channel_setenv_ex(ch.ptr, nameCStr, C.uint(len(name)), valueCStr, C.uint(len(value)))
+	})
+}
+
+// Exec runs cmd on the channel, its output is read from the channel or
+// Stdout and Stderr, and its input written to the channel or Stdin.
+func (ch *Channel) Exec(cmd string) error {
+	return ch.ExecContext(context.Background(), cmd)
+}
+
+func (ch *Channel) ExecContext(ctx context.Context, cmd string) error {
+	return ch.startup(ctx, "exec", cmd)
+}
+
+// Shell starts the login shell of the user on the channel, usually after
+// RequestPty.
+func (ch *Channel) Shell() error {
+	return ch.ShellContext(context.Background())
+}
+
+func (ch *Channel) ShellContext(ctx context.Context) error {
+	return ch.startup(ctx, "shell", "")
+}
+
+// startup starts a command, a shell or a subsystem depending on request.
+func (ch *Channel) startup(ctx context.Context, request, message string) error {
+	requestCStr := C.CString(request)
+	defer C.free(unsafe.Pointer(requestCStr))
+
+	var messageCStr *C.char
+	if message != "" {
+		messageCStr = C.CString(message)
+		defer C.free(unsafe.Pointer(messageCStr))
+	}
+
+	return ch.parent.request(ctx, "channel "+request, func() C.int {
+		return C.libssh2_channel_process_startup(ch.ptr, requestCStr, C.uint(len(request)),
+			messageCStr, C.uint(len(message)))
+	})
+}
+
+// Stdout returns the standard output of the command, it reads the channel.
+func (ch *Channel) Stdout() io.Reader {
+	ch.stdoutTaken.Store(true)
+	return ch
+}
+
+// Stderr returns the standard error of the command. The server stops
+// sending once the channel window is full, so stdout and stderr must both
+// be read, concurrently, not to get stuck.
+func (ch *Channel) Stderr() io.Reader {
+	ch.stderrTaken.Store(true)
+	return &channelStderr{ch}
+}
+
+// Stdin returns the standard input of the command, it writes to the
+// channel and closing it sends EOF.
+func (ch *Channel) Stdin() io.WriteCloser {
+	return &channelStdin{ch}
+}
+
+type channelStderr struct {
+	ch *Channel
+}
+
+func (r *channelStderr) Read(p []byte) (int, error) {
+	return r.ch.read(C.SSH_EXTENDED_DATA_STDERR, p)
+}
+
+type channelStdin struct {
+	ch *Channel
+}
+
+func (w *channelStdin) Write(p []byte) (int, error) {
+	return w.ch.Write(p)
+}
+
+func (w *channelStdin) Close() error {
+	return w.ch.CloseWrite()
+}
+
+func (ch *Channel) Read(p []byte) (int, error) {
+	return ch.read(0, p)
+}
+
+func (ch *Channel) read(stream C.int, p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	var n C.ssize_t
+	err := ch.parent.stream(context.Background(), "channel read", func() C.int {
+		n = C.libssh2_channel_read_ex(ch.ptr, stream, (*C.char)(unsafe.Pointer(&p[0])), C.size_t(len(p)))
+		if n < 0 {
+			return C.int(n)
+		}
+		// Nothing for us this time, but libssh2 didn't have to wait for it.
+		if n == 0 && C.libssh2_channel_eof(ch.ptr) == 0 {
+			return C.LIBSSH2_ERROR_EAGAIN
+		}
+		// libssh2 hides EOF while any stream has data queued, a reader of
+		// the other one may be waiting for this.
+		if n > 0 {
+			ch.parent.kick()
+		}
+		return 0
+	})
+	if err != nil {
+		return 0, err
+	} else if n == 0 {
+		return 0, io.EOF
+	}
+
+	return int(n), nil
+}
+
+func (ch *Channel) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		var n C.ssize_t
+		err := ch.parent.stream(context.Background(), "channel write", func() C.int {
+			n = C.libssh2_channel_write_ex(ch.ptr, 0, (*C.char)(unsafe.Pointer(&p[written])), C.size_t(len(p)-written))
+			if n < 0 {
+				return C.int(n)
+			}
+			return 0
+		})
+		if err != nil {
+			return written, err
+		}
+
+		written += int(n)
+	}
+
+	return written, nil
+}
+
+// CloseWrite sends EOF to the other side, the channel can still be read.
+func (ch *Channel) CloseWrite() error {
+	return ch.parent.stream(context.Background(), "channel send eof", func() C.int {
+		return C.libssh2_channel_send_eof(ch.ptr)
+	})
+}
+
+// Wait waits for the server to close the channel, which it does once the
+// command exited. The server can't send EOF before its output went through
+// the channel window, which only reopens as it's read: the readers returned
+// by Stdout and Stderr must keep reading until Wait returns, output of the
+// streams nobody asked for is discarded.
+func (ch *Channel) Wait() error {
+	var drains []io.Reader
+	if !ch.stdoutTaken.Load() {
+		drains = append(drains, ch)
+	}
+	if !ch.stderrTaken.Load() {
+		drains = append(drains, &channelStderr{ch})
+	}
+
+	errc := make(chan error, len(drains))
+	for _, r := range drains {
+		go func() {
+			_, err := io.Copy(io.Discard, r)
+			errc <- err
+		}()
+	}
+
+	err := ch.parent.stream(context.Background(), "channel wait eof", func() C.int {
+		return C.libssh2_channel_wait_eof(ch.ptr)
+	})
+	for range drains {
+		if drainErr := <-errc; err == nil {
+			err = drainErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return ch.parent.stream(context.Background(), "channel wait closed", func() C.int {
+		return C.libssh2_channel_wait_closed(ch.ptr)
+	})
+}
+
+// ExitStatus waits for the command to exit, see Wait, and returns its exit
+// status, or -1 if it was killed by a signal, see ExitSignal. It's 0 if the
+// server didn't report any.
+func (ch *Channel) ExitStatus() (int, error) {
+	if err := ch.Wait(); err != nil {
+		return 0, err
+	}
+
+	signal, _, err := ch.exitSignal()
+	if err != nil {
+		return 0, err
+	} else if signal != "" {
+		return -1, nil
+	}
+
+	return ch.exitStatus(), nil
+}
+
+func (ch *Channel) exitStatus() int {
+	ch.parent.mu.Lock()
+	defer ch.parent.mu.Unlock()
+
+	return int(C.libssh2_channel_get_exit_status(ch.ptr))
+}
+
+// ExitSignal waits for the command to exit, see Wait, and returns the name
+// of the signal that killed it, without the "SIG" prefix, and the error
+// message given by the server. The name is empty if the command exited
+// normally.
+func (ch *Channel) ExitSignal() (signal, message string, err error) {
+	if err := ch.Wait(); err != nil {
+		return "", "", err
+	}
+
+	return ch.exitSignal()
+}
+
+func (ch *Channel) exitSignal() (signal, message string, err error) {
+	var signalCStr, messageCStr *C.char
+	var signalLen, messageLen C.size_t
+	err = ch.parent.check("channel exit signal", func() C.int {
+		return C.libssh2_channel_get_exit_signal(ch.ptr, &signalCStr, &signalLen, &messageCStr, &messageLen, nil, nil)
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	if signalCStr != nil {
+		signal = C.GoStringN(signalCStr, C.int(signalLen))
+		C.libssh2_free(ch.parent.ptr, unsafe.Pointer(signalCStr))
+	}
+	if messageCStr != nil {
+		message = C.GoStringN(messageCStr, C.int(messageLen))
+		C.libssh2_free(ch.parent.ptr, unsafe.Pointer(messageCStr))
+	}
+
+	return signal, message, nil
+}
+
+// Close closes the channel and frees it.
+func (ch *Channel) Close() error {
+	err := ch.parent.stream(context.Background(), "channel close", func() C.int {
+		return C.libssh2_channel_close(ch.ptr)
+	})
+	if err != nil {
+		return err
+	}
+
+	return ch.parent.stream(context.Background(), "channel free", func() C.int {
+		return C.libssh2_channel_free(ch.ptr)
+	})
+}
@@ -0,0 +1,218 @@
+package ssh2
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testCommand plays a command run on the test server, writing to stdout and
+// stderr and returning the exit status.
+type testCommand func(stdout, stderr ssh.Channel) uint32
+
+// newTestServer starts an SSH server running cmds by name, and returns a
+// client authenticated to it.
+func newTestServer(t *testing.T, nonBlocking bool, cmds map[string]testCommand) *Client {
+	t.Helper()
+
+	addr := startTestServer(t, &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}, cmds)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := Dial(ctx, "tcp", addr, &ClientConfig{
+		User:            "test",
+		Auth:            []AuthMethod{Password("test")},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		NonBlocking:     nonBlocking,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+// startTestServer serves config, given a host key, on a local port running
+// cmds by name, and returns its address.
+func startTestServer(t *testing.T, config *ssh.ServerConfig, cmds map[string]testCommand) string {
+	t.Helper()
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go serveTestConn(conn, config, cmds)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func serveTestConn(conn net.Conn, config *ssh.ServerConfig, cmds map[string]testCommand) {
+	defer conn.Close()
+
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "")
+			continue
+		}
+
+		ch, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer ch.Close()
+
+			for req := range requests {
+				var exec struct{ Command string }
+				if req.Type != "exec" || ssh.Unmarshal(req.Payload, &exec) != nil || cmds[exec.Command] == nil {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+
+				status := cmds[exec.Command](ch, ch)
+				ch.CloseWrite()
+				ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+				return
+			}
+		}()
+	}
+}
+
+// withTimeout fails the test if fn takes longer than the timeout.
+func withTimeout(t *testing.T, timeout time.Duration, fn func()) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatalf("still running after %v", timeout)
+	}
+}
+
+func TestChannelWaitUnreadOutput(t *testing.T) {
+	// Well over the 2 MiB channel window, on both streams.
+	const size = 3 << 20
+
+	cmds := map[string]testCommand{
+		"flood": func(stdout, stderr ssh.Channel) uint32 {
+			chunk := bytes.Repeat([]byte("x"), 32<<10)
+			for range size / len(chunk) {
+				if _, err := stdout.Write(chunk); err != nil {
+					return 1
+				}
+				if _, err := stderr.Stderr().Write(chunk); err != nil {
+					return 1
+				}
+			}
+			return 7
+		},
+	}
+
+	for _, mode := range []struct {
+		name        string
+		nonBlocking bool
+	}{{"blocking", false}, {"non-blocking", true}} {
+		t.Run(mode.name, func(t *testing.T) {
+			client := newTestServer(t, mode.nonBlocking, cmds)
+
+			ch, err := client.Session().OpenChannel()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ch.Close()
+
+			if err := ch.Exec("flood"); err != nil {
+				t.Fatal(err)
+			}
+
+			// Part of the output is read, the rest is left to Wait.
+			head := make([]byte, 1<<10)
+			if _, err := ch.Read(head); err != nil {
+				t.Fatal(err)
+			}
+
+			withTimeout(t, 30*time.Second, func() {
+				status, err := ch.ExitStatus()
+				if err != nil {
+					t.Error(err)
+				} else if status != 7 {
+					t.Errorf("exit status %d, want 7", status)
+				}
+			})
+		})
+	}
+}
+
+func TestChannelSetenvDenied(t *testing.T) {
+	client := newTestServer(t, false, nil)
+
+	ch, err := client.Session().OpenChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+
+	// The test server accepts no variable.
+	err = ch.Setenv("LC_BACKUP", "1")
+
+	var e *Error
+	if !errors.As(err, &e) || e.Code != ErrorChannelRequestDenied {
+		t.Fatalf("Setenv() = %v, want an *Error of code ErrorChannelRequestDenied", err)
+	}
+	if e.Op != "channel setenv LC_BACKUP" {
+		t.Errorf("Op = %q, want %q", e.Op, "channel setenv LC_BACKUP")
+	}
+	if strings.Contains(e.Message, "LC_BACKUP") {
+		t.Errorf("Message %q names the variable", e.Message)
+	}
+}
@@ -0,0 +1,182 @@
+package ssh2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// HostKeyCallback verifies the server's host key once the handshake is done,
+// before any credential is sent. addr is the address given to Dial, remote
+// the one of the connection and session the handshaked session to query the
+// key from. Returning an error aborts the connection.
+type HostKeyCallback func(addr string, remote net.Addr, session *SshSession) error
+
+// InsecureIgnoreHostKey accepts any host key, it's only fit for tests.
+func InsecureIgnoreHostKey() HostKeyCallback {
+	return func(string, net.Addr, *SshSession) error {
+		return nil
+	}
+}
+
+type ClientConfig struct {
+	User string
+	// Auth methods are tried in order, see SshSession.Authenticate.
+	Auth []AuthMethod
+	// HostKeyCallback is mandatory, use InsecureIgnoreHostKey to skip the
+	// verification.
+	HostKeyCallback HostKeyCallback
+	// Algorithms to offer, libssh2's defaults are used for empty fields.
+	Algorithms Algorithms
+	// ClientVersion is the identification string sent to the server, see
+	// SshSession.SetBanner. libssh2's is used if it's empty.
+	ClientVersion string
+	// BannerCallback is called with the server's authentication banner, if
+	// any, whether authentication succeeded or not.
+	BannerCallback func(message string)
+	// NonBlocking drives the session in non-blocking mode, see SetBlocking.
+	NonBlocking bool
+}
+
+// Client is an authenticated SSH connection, it owns both the network
+// connection and the session running over it.
+type Client struct {
+	conn    net.Conn
+	session *SshSession
+
+	mu   sync.Mutex
+	sftp *SftpSession
+}
+
+// Dial connects to addr on network, verifies the server's host key and
+// authenticates. ctx only bounds the connection setup.
+func Dial(ctx context.Context, network, addr string, config *ClientConfig) (*Client, error) {
+	if config == nil {
+		return nil, fmt.Errorf("missing client config")
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := NewClient(ctx, conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// NewClient is like Dial over an existing connection, which the Client
+// takes ownership of on success only.
+func NewClient(ctx context.Context, conn net.Conn, addr string, config *ClientConfig) (*Client, error) {
+	if config == nil {
+		return nil, fmt.Errorf("missing client config")
+	}
+
+	if config.HostKeyCallback == nil {
+		return nil, fmt.Errorf("missing host key callback")
+	}
+
+	session, err := SessionInit()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := session.setup(ctx, conn, addr, config); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	return &Client{conn: conn, session: session}, nil
+}
+
+func (ss *SshSession) setup(ctx context.Context, conn net.Conn, addr string, config *ClientConfig) error {
+	if err := ss.SetAlgorithms(config.Algorithms); err != nil {
+		return err
+	}
+
+	if config.ClientVersion != "" {
+		if err := ss.SetBanner(config.ClientVersion); err != nil {
+			return err
+		}
+	}
+
+	if config.NonBlocking {
+		ss.SetBlocking(false)
+	}
+
+	if err := ss.HandshakeContext(ctx, conn); err != nil {
+		return err
+	}
+
+	if err := config.HostKeyCallback(addr, conn.RemoteAddr(), ss); err != nil {
+		ss.Disconnect("Host key verification failed")
+		return err
+	}
+
+	err := ss.AuthenticateContext(ctx, config.User, config.Auth...)
+
+	if config.BannerCallback != nil {
+		if banner, _ := ss.UserAuthBanner(); banner != "" {
+			config.BannerCallback(banner)
+		}
+	}
+
+	if err != nil {
+		ss.Disconnect("Authentication failed")
+		return err
+	}
+
+	return nil
+}
+
+// Session returns the underlying session, for anything Client doesn't
+// cover. It must not be closed directly.
+func (c *Client) Session() *SshSession {
+	return c.session
+}
+
+// SFTP returns the SFTP session of the client, it's started on first use and
+// shared by all callers.
+func (c *Client) SFTP() (*SftpSession, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sftp == nil {
+		sftp, err := c.session.SftpInit()
+		if err != nil {
+			return nil, err
+		}
+
+		c.sftp = sftp
+	}
+
+	return c.sftp, nil
+}
+
+// Close shuts the SFTP session down if any, disconnects, then frees the
+// session and closes the connection. Files and channels must not be used
+// afterwards.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var errs []error
+	if c.sftp != nil {
+		errs = append(errs, c.sftp.Shutdown())
+		c.sftp = nil
+	}
+
+	errs = append(errs,
+		c.session.Disconnect("Normal Shutdown"),
+		c.session.Close(),
+		c.conn.Close())
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,126 @@
+package ssh2
+
+/*
+#include <libssh2.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// attach binds the session to conn and returns the socket libssh2 should
+// talk on. Connections exposing their file descriptor (TCP, Unix sockets)
+// are handed over as is, anything else (TLS, net.Pipe, wrapped conns...) is
+// bridged through a socketpair.
+//
+// Note that a conn implementing syscall.Conn is always used through its
+// file descriptor, so wrappers overriding Read or Write on top of a
+// *net.TCPConn must hide SyscallConn to go through the bridge.
+func (ss *SshSession) attach(conn net.Conn) (C.libssh2_socket_t, error) {
+	var sock net.Conn = conn
+
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		local, err := newBridge(conn)
+		if err != nil {
+			return 0, err
+		}
+
+		ss.bridge = local
+		sock, sc = local, local
+	}
+
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		ss.detach()
+		return 0, err
+	}
+
+	var fd uintptr
+	if err := raw.Control(func(f uintptr) { fd = f }); err != nil {
+		ss.detach()
+		return 0, err
+	}
+
+	ss.conn = sock
+	ss.raw = raw
+
+	return C.libssh2_socket_t(fd), nil
+}
+
+// detach releases the socketpair used to reach a bridged conn, if any. The
+// caller's conn is left untouched, it's theirs to close.
+func (ss *SshSession) detach() {
+	if ss.bridge != nil {
+		ss.bridge.Close()
+		ss.bridge = nil
+	}
+}
+
+// newBridge creates a socketpair and pumps data between one of its ends and
+// conn. The other end is returned, for libssh2 to use.
+func newBridge(conn net.Conn) (*net.UnixConn, error) {
+	// Same dance as the standard library, hold the fork lock until the fds
+	// are marked close-on-exec.
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+
+	if err != nil {
+		return nil, os.NewSyscallError("socketpair", err)
+	}
+
+	local, err := unixConnFromFd(fds[0], "ssh2-bridge-local")
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, err
+	}
+
+	remote, err := unixConnFromFd(fds[1], "ssh2-bridge-remote")
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+
+	go func() {
+		// libssh2 side closed (or failed), we are done with remote. This
+		// also unblocks the other goroutine at its next write.
+		io.Copy(conn, remote)
+		remote.Close()
+	}()
+
+	go func() {
+		// Peer went away, forward the EOF to libssh2.
+		io.Copy(remote, conn)
+		remote.CloseWrite()
+	}()
+
+	return local, nil
+}
+
+func unixConnFromFd(fd int, name string) (*net.UnixConn, error) {
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+
+	c, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		c.Close()
+		return nil, fmt.Errorf("unexpected socketpair connection type %T", c)
+	}
+
+	return uc, nil
+}
@@ -0,0 +1,329 @@
+package ssh2
+
+/*
+#include <libssh2.h>
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"time"
+)
+
+// ErrSessionUnusable is returned by every call following one that was
+// interrupted, libssh2 can't pick the session up where it left it.
+var ErrSessionUnusable = errors.New("session unusable after interrupted operation")
+
+// Far enough in the past to interrupt any pending wait on the socket.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// SetBlocking selects how calls wait on the network. In blocking mode, the
+// default, libssh2 waits inside the call and each call in flight holds an OS
+// thread. In non-blocking mode libssh2 gives up as soon as it would block and
+// the calling goroutine is parked until the socket is ready, which lets a
+// handful of threads serve many sessions and lets goroutines share a session:
+// while one waits, the others can use it.
+func (ss *SshSession) SetBlocking(blocking bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.blocking = blocking
+	if blocking {
+		C.libssh2_session_set_blocking(ss.ptr, 1)
+	} else {
+		C.libssh2_session_set_blocking(ss.ptr, 0)
+	}
+}
+
+// do runs fn, a call into libssh2 returning one of its error codes, on
+// behalf of ctx. Failures are reported as *Error, with op as the operation.
+//
+// In blocking mode, calls with a context that can't be cancelled simply
+// block inside libssh2. Otherwise fn is driven in non-blocking mode and we
+// wait for the socket in Go, so that the wait can be interrupted. libssh2
+// offers no way to back out of an operation it started, so once a call is
+// interrupted the session is unusable: the interrupted call returns the
+// error of ctx and every subsequent one ErrSessionUnusable.
+func (ss *SshSession) do(ctx context.Context, op string, fn func() C.int) error {
+	return ss.run(ctx, op, fn, true)
+}
+
+// stream is do for channel I/O, which never waits inside libssh2: a read
+// waiting for data would hold the session, and every other channel with it.
+func (ss *SshSession) stream(ctx context.Context, op string, fn func() C.int) error {
+	return ss.run(ctx, op, fn, false)
+}
+
+func (ss *SshSession) run(ctx context.Context, op string, fn func() C.int, mayBlock bool) error {
+	// libssh2 only remembers the last error, grab its message while the
+	// session is still ours.
+	var msg string
+	call := func() C.int {
+		received := ss.received()
+		rc := fn()
+		if rc < 0 && rc != C.LIBSSH2_ERROR_EAGAIN {
+			msg = ss.lastMessage(rc)
+		}
+
+		// What libssh2 read may be someone else's, and the poller can't be
+		// relied on to tell them: data that left the socket before it
+		// looked doesn't wake it up.
+		if ss.received() != received {
+			ss.kick()
+		}
+		return rc
+	}
+
+	ss.mu.Lock()
+	if ss.err != nil {
+		defer ss.mu.Unlock()
+		return ss.err
+	}
+
+	// Nothing to wait on before Handshake, let libssh2 report the misuse.
+	if ss.raw == nil || (mayBlock && ss.blocking && ctx.Done() == nil) {
+		defer ss.mu.Unlock()
+		return newError(op, ss.block(call), msg)
+	}
+	ss.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	rc, err := ss.poll(ctx, call)
+	if err == nil {
+		return newError(op, rc, msg)
+	}
+
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
+	ss.mu.Lock()
+	if ss.err == nil {
+		ss.err = ErrSessionUnusable
+	}
+	ss.mu.Unlock()
+
+	// Waiters have to notice the session is gone.
+	ss.kick()
+
+	return err
+}
+
+// poll calls fn until it stops returning EAGAIN, parking the goroutine in
+// between.
+//
+// Reads are waited for without holding the session, the poller wakes
+// everyone up each time data arrives and they all retry: there's no telling
+// whose packets libssh2 queued. A partially sent packet on the other hand
+// must be completed by the very call that started it, so that one waits for
+// the socket with the session held.
+func (ss *SshSession) poll(ctx context.Context, fn func() C.int) (C.int, error) {
+	for {
+		ss.mu.Lock()
+		if ss.err != nil {
+			ss.mu.Unlock()
+			return 0, ss.err
+		}
+
+		gen := ss.generation()
+		rc := ss.call(fn)
+
+		var dir C.int
+		if rc == C.LIBSSH2_ERROR_EAGAIN {
+			dir = blockedOn(C.libssh2_session_block_directions(ss.ptr))
+		}
+
+		if dir == C.LIBSSH2_SESSION_BLOCK_OUTBOUND {
+			var err error
+			if rc, err = ss.flush(ctx, fn); err != nil {
+				ss.mu.Unlock()
+				return rc, err
+			}
+
+			if rc == C.LIBSSH2_ERROR_EAGAIN {
+				dir = blockedOn(C.libssh2_session_block_directions(ss.ptr))
+			}
+		}
+		ss.mu.Unlock()
+
+		if rc != C.LIBSSH2_ERROR_EAGAIN {
+			return rc, nil
+		}
+
+		if dir == 0 {
+			// libssh2 may ask to be called again without waiting on
+			// anything, it wouldn't wait for more than a second itself so
+			// give it a break.
+			timer := time.NewTimer(time.Millisecond)
+			select {
+			case <-timer.C:
+				continue
+			case <-ctx.Done():
+				timer.Stop()
+				return rc, ctx.Err()
+			}
+		}
+
+		if err := ss.waitInbound(ctx, gen); err != nil {
+			return rc, err
+		}
+	}
+}
+
+// block runs fn in blocking mode, ss.mu must be held. libssh2 only sends
+// keepalives while it waits for the socket and stops waiting with
+// LIBSSH2_ERROR_TIMEOUT each time one is due, leaving the call where EAGAIN
+// would: carry on, the next wait sends it.
+func (ss *SshSession) block(fn func() C.int) C.int {
+	for {
+		rc := fn()
+		if rc != C.LIBSSH2_ERROR_TIMEOUT || ss.keepalive.Load() == nil {
+			return rc
+		}
+	}
+}
+
+// call runs fn with libssh2 in non-blocking mode, ss.mu must be held.
+func (ss *SshSession) call(fn func() C.int) C.int {
+	if ss.blocking {
+		C.libssh2_session_set_blocking(ss.ptr, 0)
+		defer C.libssh2_session_set_blocking(ss.ptr, 1)
+	}
+
+	return fn()
+}
+
+// flush retries fn until libssh2 isn't blocked on sending anymore, ss.mu
+// must be held. fn runs from the RawConn callback, as the runtime forgets
+// about readiness it got before the callback is entered.
+func (ss *SshSession) flush(ctx context.Context, fn func() C.int) (C.int, error) {
+	fired := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		ss.conn.SetWriteDeadline(aLongTimeAgo)
+		close(fired)
+	})
+
+	var rc C.int
+	err := ss.raw.Write(func(uintptr) bool {
+		rc = ss.call(fn)
+		return rc != C.LIBSSH2_ERROR_EAGAIN ||
+			blockedOn(C.libssh2_session_block_directions(ss.ptr)) != C.LIBSSH2_SESSION_BLOCK_OUTBOUND
+	})
+
+	if !stop() {
+		<-fired
+		ss.conn.SetWriteDeadline(time.Time{})
+	}
+
+	return rc, err
+}
+
+// blockedOn picks the direction to wait on, a pending write has to be
+// flushed before anything else can happen.
+func blockedOn(dirs C.int) C.int {
+	if dirs&C.LIBSSH2_SESSION_BLOCK_OUTBOUND != 0 {
+		return C.LIBSSH2_SESSION_BLOCK_OUTBOUND
+	}
+
+	return dirs & C.LIBSSH2_SESSION_BLOCK_INBOUND
+}
+
+// generation identifies the last time data arrived, see waitInbound.
+func (ss *SshSession) generation() uint64 {
+	ss.pmu.Lock()
+	defer ss.pmu.Unlock()
+
+	return ss.gen
+}
+
+// kick wakes up every goroutine in waitInbound.
+func (ss *SshSession) kick() {
+	ss.pmu.Lock()
+	defer ss.pmu.Unlock()
+
+	ss.gen++
+	if ss.wake != nil {
+		close(ss.wake)
+	}
+	ss.wake = make(chan struct{})
+}
+
+// waitInbound parks the goroutine until data arrived since gen was taken,
+// which has to be before the call that got EAGAIN so that nothing arriving
+// in between can be missed.
+func (ss *SshSession) waitInbound(ctx context.Context, gen uint64) error {
+	ss.pollOnce.Do(ss.startPoller)
+
+	for {
+		ss.pmu.Lock()
+		if ss.gen != gen {
+			ss.pmu.Unlock()
+			return nil
+		}
+
+		if ss.pollErr != nil {
+			ss.pmu.Unlock()
+			return ss.pollErr
+		}
+
+		wake := ss.wake
+		ss.pmu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// startPoller spawns the goroutine watching the socket for incoming data on
+// behalf of waitInbound. It stays in a single RawConn.Read until the session
+// is closed, as the runtime only remembers readiness within one.
+func (ss *SshSession) startPoller() {
+	ss.kick()
+
+	go func() {
+		err := ss.raw.Read(func(uintptr) bool {
+			ss.kick()
+			return false
+		})
+
+		ss.pmu.Lock()
+		ss.pollErr = err
+		ss.pmu.Unlock()
+
+		ss.kick()
+	}()
+}
+
+// shutdown shuts the connection down under the feet of libssh2, which is
+// the only way to make a blocking call return.
+func (ss *SshSession) shutdown() {
+	ss.raw.Control(func(fd uintptr) {
+		syscall.Shutdown(int(fd), syscall.SHUT_RDWR)
+	})
+}
+
+// stopPoller makes the poller return, it doesn't own the connection so it
+// can only be done through a deadline.
+func (ss *SshSession) stopPoller() {
+	if ss.conn != nil {
+		ss.conn.SetReadDeadline(aLongTimeAgo)
+	}
+}
+
+// onlyEagain hides every error but LIBSSH2_ERROR_EAGAIN from do, for callers
+// inspecting failures on their own.
+func onlyEagain(rc C.int) C.int {
+	if rc == C.LIBSSH2_ERROR_EAGAIN {
+		return rc
+	}
+
+	return 0
+}
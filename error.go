@@ -6,10 +6,6 @@ package ssh2
 */
 import "C"
 
-import (
-	"errors"
-)
-
 //go:generate stringer -type=ErrorCode
 type ErrorCode int
 
@@ -74,13 +70,63 @@ const (
 	ErrorBannerNone            ErrorCode = C.LIBSSH2_ERROR_BANNER_NONE
 )
 
-func wrapSshError(ci C.int) error {
-	if ci < 0 {
-		code := ErrorCode(ci)
-		return errors.New(code.String())
-	} else {
+func (code ErrorCode) Error() string {
+	return code.String()
+}
+
+// Error is a failure reported by libssh2. It matches its ErrorCode with
+// errors.Is:
+//
+//	if errors.Is(err, ssh2.ErrorAuthenticationFailed) {
+//		...
+//	}
+type Error struct {
+	Code ErrorCode
+	// Operation that failed, e.g. "handshake" or "sftp open".
+	Op string
+	// Description libssh2 gave along with Code, if any.
+	Message string
+}
+
+func (e *Error) Error() string {
+	msg := e.Code.String()
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+
+	if e.Op != "" {
+		msg = e.Op + ": " + msg
+	}
+
+	return msg
+}
+
+func (e *Error) Is(target error) bool {
+	code, ok := target.(ErrorCode)
+	return ok && code == e.Code
+}
+
+// Timeout reports whether the operation gave up waiting on the network.
+func (e *Error) Timeout() bool {
+	return e.Code == ErrorTimeout || e.Code == ErrorSocketTimeout
+}
+
+// Temporary reports whether the operation may succeed if tried again.
+func (e *Error) Temporary() bool {
+	return e.Code == ErrorEagain || e.Timeout()
+}
+
+// newError returns nil unless rc is one of libssh2's error codes.
+func newError(op string, rc C.int, msg string) error {
+	if rc >= 0 {
 		return nil
 	}
+
+	return &Error{Code: ErrorCode(rc), Op: op, Message: msg}
+}
+
+func wrapSshError(ci C.int) error {
+	return newError("", ci, "")
 }
 
 //go:generate stringer -type=SftpErrorCode
@@ -110,3 +156,7 @@ const (
 	FX_INVALID_FILENAME       SftpErrorCode = C.LIBSSH2_FX_INVALID_FILENAME
 	FX_LINK_LOOP              SftpErrorCode = C.LIBSSH2_FX_LINK_LOOP
 )
+
+func (code SftpErrorCode) Error() string {
+	return code.String()
+}
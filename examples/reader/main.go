@@ -2,12 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"fmt"
 	ssh "gogossh"
 	"io"
 	"net"
-	"strings"
 )
 
 const (
@@ -19,65 +19,35 @@ const (
 )
 
 func main() {
-	conn, err := net.Dial("tcp", server)
-	if err != nil {
-		fmt.Printf("Failed to connect to %q: %s\n", server, err)
-		return
-	}
-
-	if err := ssh.Init(0); err != nil {
-		fmt.Printf("Failed to init ssh %s\n", err)
-		return
-	}
-	defer ssh.Exit()
+	config := &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{ssh.Password(password)},
+		HostKeyCallback: func(addr string, remote net.Addr, session *ssh.SshSession) error {
+			hostKey, err := session.HostKey()
+			if err != nil {
+				return err
+			}
 
-	session, err := ssh.SessionInit()
-	if err != nil {
-		fmt.Printf("Failed to init session %s\n", err)
-		return
-	}
-	defer session.Close()
+			fmt.Printf("[*] Host key %s %s\n", hostKey.Type, hostKey.FingerprintSHA256())
 
-	if err := session.Handshake(conn); err != nil {
-		fmt.Printf("Failed to handshake %s\n", err)
-		return
+			return nil
+		},
 	}
-	defer session.Disconnect("Normal Shutdown")
 
-	fingerprint, err := session.HostKeyHash(ssh.HashTypeSHA1)
+	client, err := ssh.Dial(context.Background(), "tcp", server, config)
 	if err != nil {
-		fmt.Printf("Failed to fingerprint server %s\n", err)
-		return
-	}
-
-	for i, f := range strings.Split(fingerprint, ",") {
-		fmt.Printf("[*] Fingerprint %d: %x \n", i, f)
-	}
-
-	authlist, err := session.UserAuthList(user)
-	if err != nil {
-		fmt.Printf("Failed to get auth list for user %s: %s\n", user, err)
-		return
-	}
-
-	fmt.Printf("[*] Advertised auth methods:\n")
-	for _, auth := range strings.Split(authlist, ",") {
-		fmt.Printf("Auth method %q\n", auth)
-	}
-
-	if err := session.UserAuthPassword(user, password); err != nil {
-		fmt.Printf("Failed to authenticate user %s\n", err)
+		fmt.Printf("Failed to connect to %q: %s\n", server, err)
 		return
 	}
+	defer client.Close()
 
 	fmt.Printf("[*] User %q authenticated\n", user)
 
-	sftpSession, err := session.SftpInit()
+	sftpSession, err := client.SFTP()
 	if err != nil {
 		fmt.Printf("Failed to init sftp session %s\n", err)
 		return
 	}
-	defer sftpSession.Shutdown()
 
 	fileHandle, err := sftpSession.OpenFile(file, ssh.FXFRead, 0)
 	if err != nil {
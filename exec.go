@@ -0,0 +1,373 @@
+package ssh2
+
+/*
+#include <libssh2.h>
+*/
+import "C"
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+)
+
+// Session runs a single command or shell on its own channel, with the API
+// of golang.org/x/crypto/ssh.Session.
+type Session struct {
+	// Stdin is read and sent to the command until EOF or until the command
+	// exited, the command reads EOF right away if it's nil.
+	Stdin io.Reader
+
+	// Stdout and Stderr receive the output of the command. Stdout is
+	// discarded if it's nil, and so is Stderr, which the server then needn't
+	// wait on to be read.
+	Stdout io.Writer
+	Stderr io.Writer
+
+	ch *Channel
+
+	started  bool
+	combined bool
+	// Streams handed out by the pipe methods, Start leaves them alone.
+	stdinPipe, stdoutPipe, stderrPipe bool
+
+	// Errors of the output copies started by Start, one each.
+	copies int
+	errs   chan error
+
+	// Stdin goes through a pipe Wait closes once the command exited, Stdin
+	// itself may never reach EOF.
+	stdinWriter *io.PipeWriter
+	stdinDone   chan struct{}
+	stdinErr    chan error
+}
+
+// ExitError reports a command that exited with a non-zero status or was
+// killed by a signal.
+type ExitError struct {
+	status int
+	signal string
+	msg    string
+}
+
+// ExitStatus returns the exit status of the command, or 128 plus the signal
+// number if it was killed by a signal.
+func (e *ExitError) ExitStatus() int {
+	return e.status
+}
+
+// Signal returns the name of the signal that killed the command, without the
+// "SIG" prefix, or an empty string.
+func (e *ExitError) Signal() string {
+	return e.signal
+}
+
+// Msg returns the error message given by the server along with the signal.
+func (e *ExitError) Msg() string {
+	return e.msg
+}
+
+func (e *ExitError) Error() string {
+	str := fmt.Sprintf("Process exited with status %v", e.status)
+	if e.signal != "" {
+		str += fmt.Sprintf(" from signal %v", e.signal)
+	}
+	if e.msg != "" {
+		str += fmt.Sprintf(". Reason was: %v", e.msg)
+	}
+	return str
+}
+
+// signals maps the signal names of RFC 4254 to their usual numbers.
+var signals = map[string]int{
+	"ABRT": 6,
+	"ALRM": 14,
+	"FPE":  8,
+	"HUP":  1,
+	"ILL":  4,
+	"INT":  2,
+	"KILL": 9,
+	"PIPE": 13,
+	"QUIT": 3,
+	"SEGV": 11,
+	"TERM": 15,
+	"USR1": 10,
+	"USR2": 12,
+}
+
+// NewSession opens a channel for a Session.
+func (ss *SshSession) NewSession() (*Session, error) {
+	ch, err := ss.OpenChannel()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{ch: ch}, nil
+}
+
+// NewSession opens a channel for a Session.
+func (c *Client) NewSession() (*Session, error) {
+	return c.session.NewSession()
+}
+
+// Channel returns the channel of the session, for anything Session doesn't
+// cover.
+func (s *Session) Channel() *Channel {
+	return s.ch
+}
+
+// Setenv sets an environment variable for the command, see Channel.Setenv.
+func (s *Session) Setenv(name, value string) error {
+	return s.ch.Setenv(name, value)
+}
+
+// RequestPty allocates a pseudo-terminal for the command, see
+// Channel.RequestPty.
+func (s *Session) RequestPty(term string, height, width int, modes TerminalModes) error {
+	return s.ch.RequestPty(term, height, width, modes)
+}
+
+// WindowChange tells the server the terminal was resized.
+func (s *Session) WindowChange(height, width int) error {
+	return s.ch.WindowChange(height, width)
+}
+
+// RequestAgentForwarding asks the server to forward the agent to the
+// command, see Channel.RequestAgentForwarding.
+func (s *Session) RequestAgentForwarding() error {
+	return s.ch.RequestAgentForwarding()
+}
+
+// StdinPipe returns a pipe to the standard input of the command, closing it
+// sends EOF. It can't be combined with Stdin.
+func (s *Session) StdinPipe() (io.WriteCloser, error) {
+	if s.Stdin != nil {
+		return nil, fmt.Errorf("stdin already set")
+	} else if s.started {
+		return nil, fmt.Errorf("session already started")
+	}
+
+	s.stdinPipe = true
+	return s.ch.Stdin(), nil
+}
+
+// StdoutPipe returns a pipe to the standard output of the command. It can't
+// be combined with Stdout, and must be read for the command to complete.
+func (s *Session) StdoutPipe() (io.Reader, error) {
+	if s.Stdout != nil {
+		return nil, fmt.Errorf("stdout already set")
+	} else if s.started {
+		return nil, fmt.Errorf("session already started")
+	}
+
+	s.stdoutPipe = true
+	return s.ch.Stdout(), nil
+}
+
+// StderrPipe returns a pipe to the standard error of the command. It can't
+// be combined with Stderr, and must be read for the command to complete.
+func (s *Session) StderrPipe() (io.Reader, error) {
+	if s.Stderr != nil {
+		return nil, fmt.Errorf("stderr already set")
+	} else if s.started {
+		return nil, fmt.Errorf("session already started")
+	}
+
+	s.stderrPipe = true
+	return s.ch.Stderr(), nil
+}
+
+// Start runs cmd without waiting for it to complete, see Wait.
+func (s *Session) Start(cmd string) error {
+	return s.start(func() error {
+		return s.ch.Exec(cmd)
+	})
+}
+
+// Shell starts the login shell of the user, usually after RequestPty.
+func (s *Session) Shell() error {
+	return s.start(s.ch.Shell)
+}
+
+// Run runs cmd and waits for it to complete, it fails with an *ExitError if
+// the command exited with a non-zero status or was killed.
+func (s *Session) Run(cmd string) error {
+	if err := s.Start(cmd); err != nil {
+		return err
+	}
+
+	return s.Wait()
+}
+
+// Output runs cmd and returns its standard output.
+func (s *Session) Output(cmd string) ([]byte, error) {
+	if s.Stdout != nil {
+		return nil, fmt.Errorf("stdout already set")
+	}
+
+	var b bytes.Buffer
+	s.Stdout = &b
+	err := s.Run(cmd)
+	return b.Bytes(), err
+}
+
+// CombinedOutput runs cmd and returns its standard output and standard
+// error, interleaved as the server sent them.
+func (s *Session) CombinedOutput(cmd string) ([]byte, error) {
+	if s.Stdout != nil {
+		return nil, fmt.Errorf("stdout already set")
+	} else if s.Stderr != nil {
+		return nil, fmt.Errorf("stderr already set")
+	}
+
+	var b bytes.Buffer
+	s.Stdout = &b
+	s.combined = true
+	err := s.Run(cmd)
+	return b.Bytes(), err
+}
+
+func (s *Session) start(startup func() error) error {
+	if s.started {
+		return fmt.Errorf("session already started")
+	}
+
+	// libssh2 hands stderr over with stdout or drops it on arrival, so it
+	// doesn't hold the window up.
+	mode := C.LIBSSH2_CHANNEL_EXTENDED_DATA_NORMAL
+	if s.combined {
+		mode = C.LIBSSH2_CHANNEL_EXTENDED_DATA_MERGE
+	} else if s.Stderr == nil && !s.stderrPipe {
+		mode = C.LIBSSH2_CHANNEL_EXTENDED_DATA_IGNORE
+	}
+
+	if mode != C.LIBSSH2_CHANNEL_EXTENDED_DATA_NORMAL {
+		err := s.ch.parent.stream(context.Background(), "channel handle extended data", func() C.int {
+			return C.libssh2_channel_handle_extended_data2(s.ch.ptr, C.int(mode))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := startup(); err != nil {
+		return err
+	}
+	s.started = true
+
+	if s.Stdin != nil {
+		r, w := io.Pipe()
+		s.stdinWriter = w
+		s.stdinDone = make(chan struct{})
+		s.stdinErr = make(chan error, 1)
+
+		go func() {
+			_, err := io.Copy(w, s.Stdin)
+			if err != nil && err != io.ErrClosedPipe {
+				s.stdinErr <- err
+			}
+			w.Close()
+		}()
+
+		// Failing to send what's left once the command exited is expected,
+		// it's the channel going away.
+		go func() {
+			defer close(s.stdinDone)
+			io.Copy(s.ch, r)
+			s.ch.CloseWrite()
+		}()
+	} else if !s.stdinPipe {
+		if err := s.ch.CloseWrite(); err != nil {
+			return err
+		}
+	}
+
+	var copies []func() error
+	if !s.stdoutPipe {
+		stdout := s.Stdout
+		if stdout == nil {
+			stdout = io.Discard
+		}
+
+		copies = append(copies, func() error {
+			_, err := io.Copy(stdout, s.ch.Stdout())
+			return err
+		})
+	}
+
+	if s.Stderr != nil && !s.combined {
+		copies = append(copies, func() error {
+			_, err := io.Copy(s.Stderr, s.ch.Stderr())
+			return err
+		})
+	}
+
+	s.copies = len(copies)
+	s.errs = make(chan error, len(copies))
+	for _, fn := range copies {
+		go func() {
+			s.errs <- fn()
+		}()
+	}
+
+	return nil
+}
+
+// Wait waits for the command started by Start or Shell to complete and for
+// Stdout and Stderr to be copied. Stdin is no longer read once the command
+// exited. It fails with an *ExitError if the command exited with a non-zero
+// status or was killed.
+func (s *Session) Wait() error {
+	if !s.started {
+		return fmt.Errorf("session not started")
+	}
+
+	var copyErr error
+	for range s.copies {
+		if err := <-s.errs; err != nil && copyErr == nil {
+			copyErr = err
+		}
+	}
+	s.copies = 0
+
+	waitErr := s.ch.Wait()
+
+	// What Stdin had left to give is of no use to the command anymore.
+	if s.stdinWriter != nil {
+		s.stdinWriter.Close()
+		<-s.stdinDone
+		s.stdinWriter = nil
+
+		select {
+		case err := <-s.stdinErr:
+			if copyErr == nil {
+				copyErr = err
+			}
+		default:
+		}
+	}
+
+	if waitErr != nil {
+		return waitErr
+	}
+
+	signal, msg, err := s.ch.exitSignal()
+	if err != nil {
+		return err
+	} else if signal != "" {
+		return &ExitError{status: 128 + signals[signal], signal: signal, msg: msg}
+	}
+
+	if status := s.ch.exitStatus(); status != 0 {
+		return &ExitError{status: status}
+	}
+
+	return copyErr
+}
+
+// Close closes the channel of the session, killing the command if the
+// server does so when its channel goes away.
+func (s *Session) Close() error {
+	return s.ch.Close()
+}
@@ -0,0 +1,77 @@
+package ssh2
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSessionStdinNeverClosed(t *testing.T) {
+	client := newTestServer(t, false, map[string]testCommand{
+		"true": func(stdout, stderr ssh.Channel) uint32 { return 0 },
+	})
+
+	s, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	r, w := io.Pipe()
+	defer w.Close()
+	s.Stdin = r
+
+	withTimeout(t, 10*time.Second, func() {
+		if _, err := s.Output("true"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestSessionStdoutPipe(t *testing.T) {
+	const size = 1 << 20
+
+	client := newTestServer(t, false, map[string]testCommand{
+		"flood": func(stdout, stderr ssh.Channel) uint32 {
+			stdout.Write(bytes.Repeat([]byte("x"), size))
+			return 3
+		},
+	})
+
+	for range 3 {
+		s, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stdout, err := s.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n := make(chan int64, 1)
+		go func() {
+			read, _ := io.Copy(io.Discard, stdout)
+			n <- read
+		}()
+
+		if err := s.Start("flood"); err != nil {
+			t.Fatal(err)
+		}
+
+		withTimeout(t, 30*time.Second, func() {
+			err := s.Wait()
+			if e, ok := err.(*ExitError); !ok || e.ExitStatus() != 3 {
+				t.Errorf("Wait() = %v, want exit status 3", err)
+			}
+		})
+
+		if got := <-n; got != size {
+			t.Errorf("read %d bytes from the pipe, want %d", got, size)
+		}
+		s.Close()
+	}
+}
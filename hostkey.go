@@ -4,7 +4,14 @@ package ssh2
 #include <libssh2.h>
 */
 import "C"
-import "fmt"
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unsafe"
+)
 
 type HashType int
 
@@ -14,12 +21,121 @@ const (
 	HashTypeSHA256 HashType = C.LIBSSH2_HOSTKEY_HASH_SHA256
 )
 
+// Size returns the length of the digest in bytes.
+func (htype HashType) Size() int {
+	switch htype {
+	case HashTypeMD5:
+		return 16
+	case HashTypeSHA1:
+		return 20
+	case HashTypeSHA256:
+		return 32
+	default:
+		return 0
+	}
+}
+
+type HostKeyType int
+
+const (
+	HostKeyUnknown  HostKeyType = C.LIBSSH2_HOSTKEY_TYPE_UNKNOWN
+	HostKeyRSA      HostKeyType = C.LIBSSH2_HOSTKEY_TYPE_RSA
+	HostKeyDSS      HostKeyType = C.LIBSSH2_HOSTKEY_TYPE_DSS
+	HostKeyECDSA256 HostKeyType = C.LIBSSH2_HOSTKEY_TYPE_ECDSA_256
+	HostKeyECDSA384 HostKeyType = C.LIBSSH2_HOSTKEY_TYPE_ECDSA_384
+	HostKeyECDSA521 HostKeyType = C.LIBSSH2_HOSTKEY_TYPE_ECDSA_521
+	HostKeyEd25519  HostKeyType = C.LIBSSH2_HOSTKEY_TYPE_ED25519
+)
+
+// String returns the SSH name of the key type, e.g. "ssh-ed25519".
+func (t HostKeyType) String() string {
+	switch t {
+	case HostKeyRSA:
+		return "ssh-rsa"
+	case HostKeyDSS:
+		return "ssh-dss"
+	case HostKeyECDSA256:
+		return "ecdsa-sha2-nistp256"
+	case HostKeyECDSA384:
+		return "ecdsa-sha2-nistp384"
+	case HostKeyECDSA521:
+		return "ecdsa-sha2-nistp521"
+	case HostKeyEd25519:
+		return "ssh-ed25519"
+	default:
+		return "unknown"
+	}
+}
+
+// HostKey is the server's public key, Blob being its SSH wire encoding.
+type HostKey struct {
+	Type HostKeyType
+	Blob []byte
+}
+
+// HostKey returns the key the server presented during Handshake.
+func (ss *SshSession) HostKey() (*HostKey, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	var keyLen C.size_t
+	var keyType C.int
+	key := C.libssh2_session_hostkey(ss.ptr, &keyLen, &keyType)
+	if key == nil {
+		return nil, fmt.Errorf("failed to get remote's host key")
+	}
+
+	return &HostKey{
+		Type: HostKeyType(keyType),
+		Blob: C.GoBytes(unsafe.Pointer(key), C.int(keyLen)),
+	}, nil
+}
+
+// FingerprintSHA256 returns the fingerprint as shown by ssh-keygen -l, e.g.
+// "SHA256:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU".
+func (k *HostKey) FingerprintSHA256() string {
+	return fingerprintSHA256(k.Blob)
+}
+
+// FingerprintMD5 returns the fingerprint as shown by ssh-keygen -l -E md5,
+// e.g. "MD5:d4:1d:8c:d9:8f:00:b2:04:e9:80:09:98:ec:f8:42:7e".
+func (k *HostKey) FingerprintMD5() string {
+	return fingerprintMD5(k.Blob)
+}
+
+// String formats the key like an authorized_keys entry.
+func (k *HostKey) String() string {
+	return k.Type.String() + " " + base64.StdEncoding.EncodeToString(k.Blob)
+}
+
+// HostKeyHash returns the raw digest of the server's host key, see
+// HostKey for printable fingerprints.
 func (ss *SshSession) HostKeyHash(htype HashType) (string, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
 	digestCstr := C.libssh2_hostkey_hash(ss.ptr, C.int(htype))
 
-	if digestCstr == nil {
+	if digestCstr == nil || htype.Size() == 0 {
 		return "", fmt.Errorf("failed to get remote's computed digest hostkey")
 	}
 
-	return C.GoString(digestCstr), nil
+	// It's binary, not a C string.
+	return C.GoStringN(digestCstr, C.int(htype.Size())), nil
+}
+
+func fingerprintSHA256(blob []byte) string {
+	sum := sha256.Sum256(blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+func fingerprintMD5(blob []byte) string {
+	sum := md5.Sum(blob)
+
+	hexes := make([]string, len(sum))
+	for i, b := range sum {
+		hexes[i] = fmt.Sprintf("%02x", b)
+	}
+
+	return "MD5:" + strings.Join(hexes, ":")
 }
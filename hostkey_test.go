@@ -0,0 +1,50 @@
+package ssh2
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestFingerprints(t *testing.T) {
+	// Fingerprints from ssh-keygen -l and ssh-keygen -l -E md5.
+	tests := []struct {
+		key    string
+		sha256 string
+		md5    string
+	}{
+		{
+			key:    "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAILJCP0NUAp8oOebB37cigaccPbey/dmb/G/dwnNXTFvR",
+			sha256: "SHA256:+IlNh1hVTPCRKf0Uq4dW0BS23yvV2+ChX9JLsQrOcMA",
+			md5:    "MD5:e6:4f:f6:eb:aa:be:f5:c9:82:f6:eb:de:c3:a3:16:e3",
+		},
+		{
+			key:    "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBLfUrZYWKxMWySwZnzUIplfQSOQ/zx/M2f77uFN0JNJ5uKMfVlbKOeSh3nPFb9pbXPS05dphzfaycZ4RW6CF9OI=",
+			sha256: "SHA256:oNXSFtT/yM5tlgwsM/oazhNuA+Gur/tc93u3MQzSfjs",
+			md5:    "MD5:c6:92:47:d4:9d:0f:bb:6a:47:eb:81:ac:d5:53:1d:3c",
+		},
+		{
+			key:    "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAAAgQCzMeKz/5XAv5Rb6MF7ETrU5jSyIH+z9y4RMrvIy13kqD2D6p+NfY74OIXAn14YJXUJIs7pei6l/X/N/jZxOKnmGtZr7h71QQT3oPJGy4pu2enw9gCdChGRQ+bGeJP0lnrmKmVrDvQK4mvzvHNdFdOlNevSheDA+I3zsVOYrxpL/Q==",
+			sha256: "SHA256:/HbTg56i5dRYkylCxjlb2uxImUBYXoowwUomnzOUuE8",
+			md5:    "MD5:1e:00:fc:45:d7:dd:f1:a1:94:b7:dd:16:eb:b6:96:d4",
+		},
+	}
+
+	for _, tt := range tests {
+		keyType, encoded, _ := strings.Cut(tt.key, " ")
+		t.Run(keyType, func(t *testing.T) {
+			blob, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			k := &HostKey{Blob: blob}
+			if got := k.FingerprintSHA256(); got != tt.sha256 {
+				t.Errorf("FingerprintSHA256() = %q, want %q", got, tt.sha256)
+			}
+			if got := k.FingerprintMD5(); got != tt.md5 {
+				t.Errorf("FingerprintMD5() = %q, want %q", got, tt.md5)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package ssh2
+
+/*
+#include <libssh2.h>
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrPeerUnresponsive is reported once the keepalive gave up on the peer.
+var ErrPeerUnresponsive = errors.New("peer stopped answering keepalives")
+
+type keepalive struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// StartKeepalive sends a keepalive every interval, rounded up to whole
+// seconds with a minimum of two, and declares the peer dead when maxMissed
+// intervals in a row went by without hearing anything from it. The
+// connection is then shut down, so that calls in progress fail instead of
+// hanging, the session is marked unusable and ErrPeerUnresponsive is sent on
+// the returned channel. The channel is closed once the keepalive stops.
+//
+// It must be called after Handshake. Any incoming traffic counts as an
+// answer, busy sessions don't need keepalives to be considered alive.
+func (ss *SshSession) StartKeepalive(interval time.Duration, maxMissed int) (<-chan error, error) {
+	if interval <= 0 || maxMissed < 1 {
+		return nil, fmt.Errorf("invalid keepalive interval %v or max missed %d", interval, maxMissed)
+	}
+
+	if ss.raw == nil {
+		return nil, fmt.Errorf("keepalive requires an established session")
+	}
+
+	// libssh2 counts in seconds and treats 1 as 2, the ticker has to agree
+	// with it or it would count replies to keepalives libssh2 didn't send.
+	secs := (interval + time.Second - 1) / time.Second
+	if secs < 2 {
+		secs = 2
+	}
+
+	ka := &keepalive{stop: make(chan struct{}), done: make(chan struct{})}
+	if !ss.keepalive.CompareAndSwap(nil, ka) {
+		return nil, fmt.Errorf("keepalive already running")
+	}
+
+	ss.mu.Lock()
+	C.libssh2_keepalive_config(ss.ptr, 1, C.uint(secs))
+	ss.mu.Unlock()
+
+	// The poller tells us when data arrives, whatever the mode.
+	ss.pollOnce.Do(ss.startPoller)
+
+	errc := make(chan error, 1)
+	go ss.runKeepalive(ka, secs*time.Second, maxMissed, errc)
+
+	return errc, nil
+}
+
+// StopKeepalive stops the keepalive started by StartKeepalive, if any.
+func (ss *SshSession) StopKeepalive() {
+	// Both go together under mu, blocking calls would otherwise give up on
+	// the next timeout libssh2 still wakes up for.
+	ss.mu.Lock()
+	ka := ss.keepalive.Swap(nil)
+	if ka != nil {
+		C.libssh2_keepalive_config(ss.ptr, 0, 0)
+	}
+	ss.mu.Unlock()
+
+	if ka == nil {
+		return
+	}
+
+	close(ka.stop)
+	<-ka.done
+}
+
+func (ss *SshSession) runKeepalive(ka *keepalive, interval time.Duration, maxMissed int, errc chan<- error) {
+	defer close(ka.done)
+	defer close(errc)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Sending happens on the side: the session may be held by a blocking call
+	// for a long time, which must not stop us from watching the peer. libssh2
+	// sends keepalives itself while it waits in blocking mode anyway.
+	pending := make(chan struct{}, 1)
+	send := func() {
+		select {
+		case pending <- struct{}{}:
+		default:
+			return
+		}
+
+		go func() {
+			defer func() { <-pending }()
+
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			defer cancel()
+
+			var next C.int
+			ss.do(ctx, "keepalive", func() C.int {
+				return C.libssh2_keepalive_send(ss.ptr, &next)
+			})
+		}()
+	}
+
+	// The session must not go away under a send in progress.
+	defer func() { pending <- struct{}{} }()
+
+	missed := 0
+	gen := ss.generation()
+	send()
+
+	for {
+		select {
+		case <-ka.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if cur := ss.generation(); cur != gen {
+			gen = cur
+			missed = 0
+		} else if missed++; missed >= maxMissed {
+			ss.abort(ErrPeerUnresponsive)
+			errc <- ErrPeerUnresponsive
+			return
+		}
+
+		send()
+	}
+}
+
+// abort marks the session unusable with err and shuts the connection down,
+// so that calls in progress fail.
+func (ss *SshSession) abort(err error) {
+	ss.shutdown()
+
+	ss.mu.Lock()
+	if ss.err == nil {
+		ss.err = err
+	}
+	ss.mu.Unlock()
+
+	ss.kick()
+}
@@ -0,0 +1,284 @@
+package ssh2
+
+/*
+#include <libssh2.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"unsafe"
+)
+
+type KnownHostStatus int
+
+const (
+	KnownHostMatch    KnownHostStatus = C.LIBSSH2_KNOWNHOST_CHECK_MATCH
+	KnownHostMismatch KnownHostStatus = C.LIBSSH2_KNOWNHOST_CHECK_MISMATCH
+	KnownHostNotFound KnownHostStatus = C.LIBSSH2_KNOWNHOST_CHECK_NOTFOUND
+)
+
+var (
+	ErrHostKeyMismatch = errors.New("host key mismatch")
+	ErrHostKeyNotFound = errors.New("host key not found")
+)
+
+// KnownHosts is a collection of host keys, as found in OpenSSH known_hosts
+// files.
+type KnownHosts struct {
+	parent *SshSession
+	ptr    *C.LIBSSH2_KNOWNHOSTS
+}
+
+func (ss *SshSession) KnownHostsInit() (*KnownHosts, error) {
+	kh := &KnownHosts{parent: ss}
+	kh.ptr = C.libssh2_knownhost_init(ss.ptr)
+
+	if kh.ptr == nil {
+		return nil, fmt.Errorf("failed to initialize known hosts")
+	}
+
+	return kh, nil
+}
+
+func (kh *KnownHosts) Free() {
+	C.libssh2_knownhost_free(kh.ptr)
+}
+
+// ReadFile adds the entries of the known_hosts file at path and returns how
+// many were read.
+func (kh *KnownHosts) ReadFile(path string) (int, error) {
+	pathCStr := C.CString(path)
+	defer C.free(unsafe.Pointer(pathCStr))
+
+	var n C.int
+	err := kh.parent.check("known hosts read", func() C.int {
+		n = C.libssh2_knownhost_readfile(kh.ptr, pathCStr, C.LIBSSH2_KNOWNHOST_FILE_OPENSSH)
+		return n
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// ReadLine adds the entry of a single known_hosts line.
+func (kh *KnownHosts) ReadLine(line string) error {
+	lineCStr := C.CString(line)
+	defer C.free(unsafe.Pointer(lineCStr))
+
+	return kh.parent.check("known hosts read", func() C.int {
+		return C.libssh2_knownhost_readline(kh.ptr, lineCStr, C.size_t(len(line)), C.LIBSSH2_KNOWNHOST_FILE_OPENSSH)
+	})
+}
+
+// WriteFile replaces the file at path with every entry of the collection.
+// Comments and lines libssh2 doesn't understand aren't preserved.
+func (kh *KnownHosts) WriteFile(path string) error {
+	pathCStr := C.CString(path)
+	defer C.free(unsafe.Pointer(pathCStr))
+
+	return kh.parent.check("known hosts write", func() C.int {
+		return C.libssh2_knownhost_writefile(kh.ptr, pathCStr, C.LIBSSH2_KNOWNHOST_FILE_OPENSSH)
+	})
+}
+
+// Check looks up the server's host key under host and port. Like OpenSSH,
+// hosts on a port other than 22 are only known as [host]:port.
+func (kh *KnownHosts) Check(host string, port int) (KnownHostStatus, error) {
+	hostKey, err := kh.parent.HostKey()
+	if err != nil {
+		return 0, err
+	}
+	key := hostKey.Blob
+
+	typemask, err := knownHostKeyType(hostKey.Type)
+	if err != nil {
+		return 0, err
+	}
+
+	nameCStr := C.CString(knownHostName(host, port))
+	defer C.free(unsafe.Pointer(nameCStr))
+
+	keyCStr := C.CBytes(key)
+	defer C.free(keyCStr)
+
+	var status C.int
+	err = kh.parent.check("known hosts check", func() C.int {
+		// The port is already part of the name.
+		status = C.libssh2_knownhost_checkp(kh.ptr, nameCStr, -1, (*C.char)(keyCStr), C.size_t(len(key)),
+			C.LIBSSH2_KNOWNHOST_TYPE_PLAIN|C.LIBSSH2_KNOWNHOST_KEYENC_RAW|typemask, nil)
+		if status == C.LIBSSH2_KNOWNHOST_CHECK_FAILURE {
+			return C.libssh2_session_last_errno(kh.parent.ptr)
+		}
+		return 0
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if status == C.LIBSSH2_KNOWNHOST_CHECK_FAILURE {
+		return 0, fmt.Errorf("failed to check %s against known hosts", host)
+	}
+
+	return KnownHostStatus(status), nil
+}
+
+// Add adds the server's host key under host and port, with an optional
+// comment. When hashed is set the host name is stored as a salted hash,
+// like OpenSSH's HashKnownHosts does. The entry is returned as a known_hosts
+// line, ready to be appended to a file.
+func (kh *KnownHosts) Add(host string, port int, comment string, hashed bool) (string, error) {
+	hostKey, err := kh.parent.HostKey()
+	if err != nil {
+		return "", err
+	}
+	key := hostKey.Blob
+
+	typemask, err := knownHostKeyType(hostKey.Type)
+	if err != nil {
+		return "", err
+	}
+	typemask |= C.LIBSSH2_KNOWNHOST_KEYENC_RAW
+
+	name := knownHostName(host, port)
+
+	var salt string
+	if hashed {
+		rawSalt := make([]byte, sha1.Size)
+		if _, err := rand.Read(rawSalt); err != nil {
+			return "", err
+		}
+
+		mac := hmac.New(sha1.New, rawSalt)
+		mac.Write([]byte(name))
+
+		name = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+		salt = base64.StdEncoding.EncodeToString(rawSalt)
+		typemask |= C.LIBSSH2_KNOWNHOST_TYPE_SHA1
+	} else {
+		typemask |= C.LIBSSH2_KNOWNHOST_TYPE_PLAIN
+	}
+
+	nameCStr := C.CString(name)
+	defer C.free(unsafe.Pointer(nameCStr))
+
+	saltCStr := C.CString(salt)
+	defer C.free(unsafe.Pointer(saltCStr))
+
+	keyCStr := C.CBytes(key)
+	defer C.free(keyCStr)
+
+	var commentCStr *C.char
+	if comment != "" {
+		commentCStr = C.CString(comment)
+		defer C.free(unsafe.Pointer(commentCStr))
+	}
+
+	var entry *C.struct_libssh2_knownhost
+	err = kh.parent.check("known hosts add", func() C.int {
+		return C.libssh2_knownhost_addc(kh.ptr, nameCStr, saltCStr, (*C.char)(keyCStr), C.size_t(len(key)),
+			commentCStr, C.size_t(len(comment)), typemask, &entry)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, 4096)
+	var outLen C.size_t
+	err = kh.parent.check("known hosts add", func() C.int {
+		return C.libssh2_knownhost_writeline(kh.ptr, entry, (*C.char)(unsafe.Pointer(&buf[0])), C.size_t(len(buf)),
+			&outLen, C.LIBSSH2_KNOWNHOST_FILE_OPENSSH)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return string(buf[:outLen]), nil
+}
+
+// KnownHostsCallback verifies host keys against the known_hosts files at
+// paths, a missing file being the same as an empty one. The returned error
+// wraps ErrHostKeyMismatch or ErrHostKeyNotFound when the key isn't trusted.
+func KnownHostsCallback(paths ...string) HostKeyCallback {
+	return func(addr string, remote net.Addr, session *SshSession) error {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return fmt.Errorf("invalid port in %q", addr)
+		}
+
+		kh, err := session.KnownHostsInit()
+		if err != nil {
+			return err
+		}
+		defer kh.Free()
+
+		for _, path := range paths {
+			if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			if _, err := kh.ReadFile(path); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		}
+
+		status, err := kh.Check(host, port)
+		if err != nil {
+			return err
+		}
+
+		switch status {
+		case KnownHostMatch:
+			return nil
+		case KnownHostMismatch:
+			return fmt.Errorf("%s: %w", addr, ErrHostKeyMismatch)
+		default:
+			return fmt.Errorf("%s: %w", addr, ErrHostKeyNotFound)
+		}
+	}
+}
+
+// knownHostName returns the name OpenSSH knows host on port as.
+func knownHostName(host string, port int) string {
+	if port == 22 || port == 0 {
+		return host
+	}
+
+	return "[" + host + "]:" + strconv.Itoa(port)
+}
+
+// knownHostKeyType maps keyType to its known hosts counterpart.
+func knownHostKeyType(keyType HostKeyType) (C.int, error) {
+	switch keyType {
+	case HostKeyRSA:
+		return C.LIBSSH2_KNOWNHOST_KEY_SSHRSA, nil
+	case HostKeyDSS:
+		return C.LIBSSH2_KNOWNHOST_KEY_SSHDSS, nil
+	case HostKeyECDSA256:
+		return C.LIBSSH2_KNOWNHOST_KEY_ECDSA_256, nil
+	case HostKeyECDSA384:
+		return C.LIBSSH2_KNOWNHOST_KEY_ECDSA_384, nil
+	case HostKeyECDSA521:
+		return C.LIBSSH2_KNOWNHOST_KEY_ECDSA_521, nil
+	case HostKeyEd25519:
+		return C.LIBSSH2_KNOWNHOST_KEY_ED25519, nil
+	default:
+		return 0, fmt.Errorf("unsupported host key type %v", keyType)
+	}
+}
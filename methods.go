@@ -0,0 +1,157 @@
+package ssh2
+
+/*
+#include <libssh2.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"strings"
+	"unsafe"
+)
+
+type MethodType int
+
+const (
+	MethodKex      MethodType = C.LIBSSH2_METHOD_KEX
+	MethodHostKey  MethodType = C.LIBSSH2_METHOD_HOSTKEY
+	MethodCryptCS  MethodType = C.LIBSSH2_METHOD_CRYPT_CS
+	MethodCryptSC  MethodType = C.LIBSSH2_METHOD_CRYPT_SC
+	MethodMacCS    MethodType = C.LIBSSH2_METHOD_MAC_CS
+	MethodMacSC    MethodType = C.LIBSSH2_METHOD_MAC_SC
+	MethodCompCS   MethodType = C.LIBSSH2_METHOD_COMP_CS
+	MethodCompSC   MethodType = C.LIBSSH2_METHOD_COMP_SC
+	MethodLangCS   MethodType = C.LIBSSH2_METHOD_LANG_CS
+	MethodLangSC   MethodType = C.LIBSSH2_METHOD_LANG_SC
+	MethodSignAlgo MethodType = C.LIBSSH2_METHOD_SIGN_ALGO
+)
+
+// Algorithms lists the algorithms to offer during the handshake, by order of
+// preference. Empty fields keep libssh2's defaults.
+type Algorithms struct {
+	KeyExchanges []string
+	HostKeys     []string
+	Ciphers      []string
+	MACs         []string
+	Compressions []string
+}
+
+// NegotiatedAlgorithms are the algorithms picked during the handshake, CS
+// and SC being the client to server and server to client directions.
+type NegotiatedAlgorithms struct {
+	KeyExchange   string
+	HostKey       string
+	CipherCS      string
+	CipherSC      string
+	MACCS         string
+	MACSC         string
+	CompressionCS string
+	CompressionSC string
+}
+
+// MethodPref sets the preferred algorithms for method, it has to be called
+// before Handshake. Algorithms unknown to libssh2 are ignored, it's an error
+// if none is left.
+func (ss *SshSession) MethodPref(method MethodType, prefs []string) error {
+	prefsCStr := C.CString(strings.Join(prefs, ","))
+	defer C.free(unsafe.Pointer(prefsCStr))
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	rc := C.libssh2_session_method_pref(ss.ptr, C.int(method), prefsCStr)
+	return newError("method pref", rc, ss.lastMessage(rc))
+}
+
+// SetAlgorithms applies algs to both directions, it has to be called before
+// Handshake.
+func (ss *SshSession) SetAlgorithms(algs Algorithms) error {
+	prefs := []struct {
+		methods []MethodType
+		algs    []string
+	}{
+		{[]MethodType{MethodKex}, algs.KeyExchanges},
+		{[]MethodType{MethodHostKey}, algs.HostKeys},
+		{[]MethodType{MethodCryptCS, MethodCryptSC}, algs.Ciphers},
+		{[]MethodType{MethodMacCS, MethodMacSC}, algs.MACs},
+		{[]MethodType{MethodCompCS, MethodCompSC}, algs.Compressions},
+	}
+
+	// libssh2 only offers "none" unless compression is explicitly enabled,
+	// and checks the preferences against what it offers.
+	for _, comp := range algs.Compressions {
+		if comp != "none" {
+			ss.mu.Lock()
+			rc := C.libssh2_session_flag(ss.ptr, C.LIBSSH2_FLAG_COMPRESS, 1)
+			ss.mu.Unlock()
+
+			if err := newError("enable compression", rc, ""); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	for _, pref := range prefs {
+		if len(pref.algs) == 0 {
+			continue
+		}
+
+		for _, method := range pref.methods {
+			if err := ss.MethodPref(method, pref.algs); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Method returns the algorithm negotiated for method, or an empty string
+// before Handshake.
+func (ss *SshSession) Method(method MethodType) string {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	algCStr := C.libssh2_session_methods(ss.ptr, C.int(method))
+	if algCStr == nil {
+		return ""
+	}
+
+	return C.GoString(algCStr)
+}
+
+func (ss *SshSession) NegotiatedAlgorithms() NegotiatedAlgorithms {
+	return NegotiatedAlgorithms{
+		KeyExchange:   ss.Method(MethodKex),
+		HostKey:       ss.Method(MethodHostKey),
+		CipherCS:      ss.Method(MethodCryptCS),
+		CipherSC:      ss.Method(MethodCryptSC),
+		MACCS:         ss.Method(MethodMacCS),
+		MACSC:         ss.Method(MethodMacSC),
+		CompressionCS: ss.Method(MethodCompCS),
+		CompressionSC: ss.Method(MethodCompSC),
+	}
+}
+
+// SupportedAlgorithms lists the algorithms the linked libssh2 supports for
+// method.
+func (ss *SshSession) SupportedAlgorithms(method MethodType) ([]string, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	var algs **C.char
+	n := C.libssh2_session_supported_algs(ss.ptr, C.int(method), &algs)
+	if n < 0 {
+		return nil, newError("supported algorithms", n, ss.lastMessage(n))
+	}
+	defer C.libssh2_free(ss.ptr, unsafe.Pointer(algs))
+
+	out := make([]string, 0, int(n))
+	for _, alg := range unsafe.Slice(algs, int(n)) {
+		out = append(out, C.GoString(alg))
+	}
+
+	return out, nil
+}
@@ -0,0 +1,93 @@
+package ssh2
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// offeredCompressions runs a handshake against a listener that only reads
+// the client's KEXINIT, and returns the compressions it offered both ways.
+func offeredCompressions(t *testing.T, algs Algorithms) (cs, sc []string) {
+	t.Helper()
+
+	ss, err := SessionInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+
+	if err := ss.SetAlgorithms(algs); err != nil {
+		t.Fatal(err)
+	}
+
+	// The handshake must be over before the session goes away.
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	defer func() {
+		server.Close()
+		<-done
+	}()
+
+	go func() {
+		defer close(done)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		ss.HandshakeContext(ctx, client)
+	}()
+
+	server.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.WriteString(server, "SSH-2.0-test\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(server)
+	if _, err := r.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	packet := make([]byte, binary.BigEndian.Uint32(header[:4])-1)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		t.Fatal(err)
+	}
+
+	// Message number and cookie, then the kex, host key, cipher and MAC
+	// lists before the compressions.
+	rest := packet[1+16:]
+	var lists [8][]string
+	for i := range lists {
+		list, next, ok := readString(rest)
+		if !ok {
+			t.Fatal("malformed KEXINIT")
+		}
+		lists[i], rest = strings.Split(string(list), ","), next
+	}
+
+	return lists[6], lists[7]
+}
+
+func TestSetAlgorithmsCompression(t *testing.T) {
+	for _, want := range [][]string{
+		{"zlib@openssh.com", "zlib"},
+		{"zlib", "none"},
+		{"none"},
+	} {
+		t.Run(strings.Join(want, ","), func(t *testing.T) {
+			cs, sc := offeredCompressions(t, Algorithms{Compressions: want})
+			if !reflect.DeepEqual(cs, want) || !reflect.DeepEqual(sc, want) {
+				t.Errorf("offered %q and %q, want %q", cs, sc, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package ssh2
+
+/*
+#include <libssh2.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"context"
+	"encoding/binary"
+	"maps"
+	"slices"
+	"unsafe"
+)
+
+// Terminal mode opcodes, see RFC 4254 section 8.
+const (
+	VINTR         = 1
+	VQUIT         = 2
+	VERASE        = 3
+	VKILL         = 4
+	VEOF          = 5
+	VEOL          = 6
+	VEOL2         = 7
+	VSTART        = 8
+	VSTOP         = 9
+	VSUSP         = 10
+	VDSUSP        = 11
+	VREPRINT      = 12
+	VWERASE       = 13
+	VLNEXT        = 14
+	VFLUSH        = 15
+	VSWTCH        = 16
+	VSTATUS       = 17
+	VDISCARD      = 18
+	IGNPAR        = 30
+	PARMRK        = 31
+	INPCK         = 32
+	ISTRIP        = 33
+	INLCR         = 34
+	IGNCR         = 35
+	ICRNL         = 36
+	IUCLC         = 37
+	IXON          = 38
+	IXANY         = 39
+	IXOFF         = 40
+	IMAXBEL       = 41
+	IUTF8         = 42
+	ISIG          = 50
+	ICANON        = 51
+	XCASE         = 52
+	ECHO          = 53
+	ECHOE         = 54
+	ECHOK         = 55
+	ECHONL        = 56
+	NOFLSH        = 57
+	TOSTOP        = 58
+	IEXTEN        = 59
+	ECHOCTL       = 60
+	ECHOKE        = 61
+	PENDIN        = 62
+	OPOST         = 70
+	OLCUC         = 71
+	ONLCR         = 72
+	OCRNL         = 73
+	ONOCR         = 74
+	ONLRET        = 75
+	CS7           = 90
+	CS8           = 91
+	PARENB        = 92
+	PARODD        = 93
+	TTY_OP_ISPEED = 128
+	TTY_OP_OSPEED = 129
+)
+
+// TerminalModes maps terminal mode opcodes to their values, e.g.
+// {ECHO: 1, TTY_OP_ISPEED: 38400}.
+type TerminalModes map[uint8]uint32
+
+// encode returns the modes in wire format, ordered by opcode.
+func (tm TerminalModes) encode() []byte {
+	var b []byte
+	for _, op := range slices.Sorted(maps.Keys(tm)) {
+		b = append(b, op)
+		b = binary.BigEndian.AppendUint32(b, tm[op])
+	}
+
+	// TTY_OP_END
+	return append(b, 0)
+}
+
+// RequestPty allocates a pseudo-terminal of type term, e.g. "xterm-256color",
+// for the shell or command run on the channel afterwards. height and width
+// are in characters. libssh2 caps the term name and the encoded modes to 256
+// bytes together, 5 bytes per mode.
+func (ch *Channel) RequestPty(term string, height, width int, modes TerminalModes) error {
+	return ch.RequestPtyContext(context.Background(), term, height, width, modes)
+}
+
+func (ch *Channel) RequestPtyContext(ctx context.Context, term string, height, width int, modes TerminalModes) error {
+	termCStr := C.CString(term)
+	defer C.free(unsafe.Pointer(termCStr))
+
+	encoded := modes.encode()
+	modesCStr := C.CBytes(encoded)
+	defer C.free(modesCStr)
+
+	return ch.parent.request(ctx, "channel request pty", func() C.int {
+		return C.libssh2_channel_request_pty_ex(ch.ptr, termCStr, C.uint(len(term)),
+			(*C.char)(modesCStr), C.uint(len(encoded)), C.int(width), C.int(height), 0, 0)
+	})
+}
+
+// WindowChange tells the server the terminal was resized, e.g. on SIGWINCH.
+func (ch *Channel) WindowChange(height, width int) error {
+	// No reply is expected, it doesn't have to wait for other requests.
+	return ch.parent.stream(context.Background(), "channel window change", func() C.int {
+		return C.libssh2_channel_request_pty_size_ex(ch.ptr, C.int(width), C.int(height), 0, 0)
+	})
+}
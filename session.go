@@ -1,15 +1,45 @@
 package ssh2
 
 /*
+#include <errno.h>
 #include <libssh2.h>
 #include <stdlib.h>
+#include <sys/socket.h>
+
+// What the session abstract points to.
+typedef struct {
+	uintptr_t handle;
+	// Bytes libssh2 read from the socket, see counting_recv.
+	uint64_t received;
+} session_abstract;
+
+// counting_recv is libssh2's own recv, plus the byte count.
+static ssize_t counting_recv(libssh2_socket_t sock, void *buffer, size_t length, int flags, void **abstract) {
+	ssize_t rc = recv(sock, buffer, length, flags);
+	if (rc < 0) {
+		if (errno == EINTR || errno == ENOENT || errno == EWOULDBLOCK)
+			return -EAGAIN;
+		return -errno;
+	}
+
+	((session_abstract *)*abstract)->received += rc;
+	return rc;
+}
+
+static void set_counting_recv(LIBSSH2_SESSION *session) {
+	libssh2_session_callback_set2(session, LIBSSH2_CALLBACK_RECV, (libssh2_cb_generic *)counting_recv);
+}
 */
 import "C"
 
 import (
+	"context"
 	"fmt"
 	"net"
-	"reflect"
+	"runtime/cgo"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"unsafe"
 )
 
@@ -35,30 +65,113 @@ const (
 
 type SshSession struct {
 	ptr *C.LIBSSH2_SESSION
+
+	// Lets C callbacks find the session back, through the session abstract
+	// which starts with the handle.
+	handle   cgo.Handle
+	abstract *C.session_abstract
+
+	// Connection libssh2 reads from and writes to, either the one given to
+	// Handshake or our end of the bridge to it.
+	conn   net.Conn
+	raw    syscall.RawConn
+	bridge *net.UnixConn
+
+	// Serializes calls into libssh2, see do.
+	mu       sync.Mutex
+	blocking bool
+	// Set once an interrupted operation left the session in an unknown state.
+	err error
+
+	// Incoming data notifications, see waitInbound.
+	pmu      sync.Mutex
+	pollOnce sync.Once
+	pollErr  error
+	gen      uint64
+	wake     chan struct{}
+
+	keepalive atomic.Pointer[keepalive]
+
+	// Channel opens and requests go one at a time, see request.
+	reqmu sync.Mutex
+
+	// State of the call in progress for callbacks, set under mu.
+	kbdint         *kbdintCall
+	signer         *signCall
+	passwordChange *passwordChangeCall
+
+	// Agent the server's agent channels are relayed to, see ForwardAgent.
+	forwardAgent *string
+	relays       sync.WaitGroup
 }
 
 func SessionInit() (*SshSession, error) {
 	sess := &SshSession{}
-	sess.ptr = C.libssh2_session_init_ex(nil, nil, nil, nil)
+	sess.handle = cgo.NewHandle(sess)
+	sess.abstract = (*C.session_abstract)(C.calloc(1, C.sizeof_session_abstract))
+	sess.abstract.handle = C.uintptr_t(sess.handle)
+
+	sess.ptr = C.libssh2_session_init_ex(nil, nil, nil, unsafe.Pointer(sess.abstract))
 
 	if sess.ptr == nil {
+		sess.release()
 		return nil, fmt.Errorf("failed to create ssh session")
 	}
 
+	C.set_counting_recv(sess.ptr)
+
 	// Opinionated, but this is goland, everything is blocking we just punt to
 	// goroutines.
 	C.libssh2_session_set_blocking(sess.ptr, 1)
+	sess.blocking = true
 
 	return sess, nil
 }
 
+// Handshake starts the SSH session over conn, which can be any net.Conn.
+// The session keeps using conn until it's closed, but doesn't take
+// ownership of it: the caller must close it after Close.
 func (ss *SshSession) Handshake(conn net.Conn) error {
-	v := reflect.Indirect(reflect.ValueOf(conn))
-	con := v.FieldByName("conn")
-	netFD := reflect.Indirect(con.FieldByName("fd"))
-	pfd := netFD.FieldByName("pfd")
-	fd := int(pfd.FieldByName("Sysfd").Int())
-	return wrapSshError(C.libssh2_session_handshake(ss.ptr, C.libssh2_socket_t(fd)))
+	return ss.HandshakeContext(context.Background(), conn)
+}
+
+// HandshakeContext is like Handshake but gives up when ctx is done, in which
+// case the session can only be closed, which then shuts conn down.
+func (ss *SshSession) HandshakeContext(ctx context.Context, conn net.Conn) error {
+	sock, err := ss.attach(conn)
+	if err != nil {
+		return err
+	}
+
+	return ss.do(ctx, "handshake", func() C.int {
+		return C.libssh2_session_handshake(ss.ptr, sock)
+	})
+}
+
+// SetBanner sets the identification string sent to the server, e.g.
+// "SSH-2.0-backup_1.0", instead of libssh2's. It has to be called before
+// Handshake.
+func (ss *SshSession) SetBanner(banner string) error {
+	bannerCStr := C.CString(banner)
+	defer C.free(unsafe.Pointer(bannerCStr))
+
+	return ss.check("banner set", func() C.int {
+		return C.libssh2_session_banner_set(ss.ptr, bannerCStr)
+	})
+}
+
+// Banner returns the identification string of the server, e.g.
+// "SSH-2.0-OpenSSH_9.6", or an empty string before Handshake.
+func (ss *SshSession) Banner() string {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	bannerCStr := C.libssh2_session_banner_get(ss.ptr)
+	if bannerCStr == nil {
+		return ""
+	}
+
+	return C.GoString(bannerCStr)
 }
 
 func (ss *SshSession) Disconnect(desc string) error {
@@ -67,13 +180,82 @@ func (ss *SshSession) Disconnect(desc string) error {
 	defer C.free(unsafe.Pointer(langCstr))
 	defer C.free(unsafe.Pointer(descCstr))
 
-	return wrapSshError(C.libssh2_session_disconnect_ex(ss.ptr, C.int(DisconnectByApplication), descCstr, langCstr))
+	return ss.do(context.Background(), "disconnect", func() C.int {
+		return C.libssh2_session_disconnect_ex(ss.ptr, C.int(DisconnectByApplication), descCstr, langCstr)
+	})
 }
 
 func (ss *SshSession) Close() error {
-	return wrapSshError(C.libssh2_session_free(ss.ptr))
+	ss.StopKeepalive()
+	ss.stopPoller()
+
+	// Relays give up once the poller is gone, their channels must not be
+	// freed under them.
+	ss.relays.Wait()
+
+	ss.mu.Lock()
+	// libssh2 closes the channels left open and waits for the server to
+	// agree, which may never happen on a session we gave up on.
+	if ss.err != nil && ss.raw != nil {
+		ss.shutdown()
+	}
+	err := wrapSshError(C.libssh2_session_free(ss.ptr))
+	ss.mu.Unlock()
+
+	ss.detach()
+	ss.release()
+
+	return err
+}
+
+// release frees what lets callbacks reach the session.
+func (ss *SshSession) release() {
+	ss.handle.Delete()
+	C.free(unsafe.Pointer(ss.abstract))
+}
+
+// sessionFromAbstract returns the session of a callback given its abstract.
+func sessionFromAbstract(abstract *unsafe.Pointer) *SshSession {
+	return cgo.Handle((*C.session_abstract)(*abstract).handle).Value().(*SshSession)
+}
+
+// received returns how many bytes libssh2 read so far, ss.mu must be held.
+func (ss *SshSession) received() uint64 {
+	return uint64(ss.abstract.received)
 }
 
 func (ss *SshSession) GetLastError() error {
-	return wrapSshError(C.libssh2_session_last_error(ss.ptr, nil, nil, 0))
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	return ss.lastError("")
+}
+
+// check runs fn, a libssh2 call that doesn't involve the server but records
+// its errors on the session.
+func (ss *SshSession) check(op string, fn func() C.int) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	rc := fn()
+	return newError(op, rc, ss.lastMessage(rc))
+}
+
+// lastError returns the last error recorded on the session, as *Error, or
+// nil. ss.mu must be held.
+func (ss *SshSession) lastError(op string) error {
+	rc := C.libssh2_session_last_errno(ss.ptr)
+	return newError(op, rc, ss.lastMessage(rc))
+}
+
+// lastMessage returns the description of the last error if it's rc, ss.mu
+// must be held.
+func (ss *SshSession) lastMessage(rc C.int) string {
+	var msg *C.char
+	var msgLen C.int
+	if C.libssh2_session_last_error(ss.ptr, &msg, &msgLen, 0) != rc || msg == nil {
+		return ""
+	}
+
+	return C.GoStringN(msg, msgLen)
 }
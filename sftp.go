@@ -8,11 +8,12 @@ package ssh2
 import "C"
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"sync"
 	"syscall"
 	"time"
 	"unsafe"
@@ -21,6 +22,10 @@ import (
 type SftpSession struct {
 	parent *SshSession
 	ptr    *C.LIBSSH2_SFTP
+
+	// libssh2 keeps the state of SFTP operations per SFTP session, they
+	// can't overlap even in non-blocking mode.
+	mu sync.Mutex
 }
 
 // Implements io.Reader interface
@@ -94,8 +99,25 @@ func (fi *sftpFileInfo) Sys() any {
 }
 
 func (ss *SshSession) SftpInit() (*SftpSession, error) {
+	return ss.SftpInitContext(context.Background())
+}
+
+func (ss *SshSession) SftpInitContext(ctx context.Context) (*SftpSession, error) {
+	// It opens a channel, see request.
+	ss.reqmu.Lock()
+	defer ss.reqmu.Unlock()
+
 	sftpSession := &SftpSession{parent: ss}
-	sftpSession.ptr = C.libssh2_sftp_init(ss.ptr)
+	err := ss.do(ctx, "sftp init", func() C.int {
+		sftpSession.ptr = C.libssh2_sftp_init(ss.ptr)
+		if sftpSession.ptr == nil {
+			return C.libssh2_session_last_errno(ss.ptr)
+		}
+		return 0
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	if sftpSession.ptr == nil {
 		return nil, fmt.Errorf("failed to initialize sftp session")
@@ -105,7 +127,12 @@ func (ss *SshSession) SftpInit() (*SftpSession, error) {
 }
 
 func (ss *SftpSession) Shutdown() error {
-	return wrapSshError(C.libssh2_sftp_shutdown(ss.ptr))
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	return ss.parent.do(context.Background(), "sftp shutdown", func() C.int {
+		return C.libssh2_sftp_shutdown(ss.ptr)
+	})
 }
 
 type OpenFlags int
@@ -155,18 +182,24 @@ func (ss *SftpSession) GetLastError() error {
 	case FX_PERMISSION_DENIED:
 		return os.ErrPermission
 	default:
-		return errors.New(code.String())
+		return code
 	}
 }
 
 func (ss *SftpSession) OpenFile(path string, flags OpenFlags, mode FileMode) (*SftpFile, error) {
-	pathnameCStr := C.CString(path)
-	defer C.free(unsafe.Pointer(pathnameCStr))
+	return ss.OpenFileContext(context.Background(), path, flags, mode)
+}
 
-	handle := &SftpFile{parent: ss}
-	handle.ptr = C.libssh2_sftp_open_ex(ss.ptr, pathnameCStr, C.uint(len(path)), C.ulong(flags), C.long(mode), C.LIBSSH2_SFTP_OPENFILE)
+func (ss *SftpSession) OpenFileContext(ctx context.Context, path string, flags OpenFlags, mode FileMode) (*SftpFile, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
 
-	if handle.ptr == nil {
+	ptr, err := ss.open(ctx, path, flags, mode, C.LIBSSH2_SFTP_OPENFILE)
+	if err != nil {
+		return nil, err
+	}
+
+	if ptr == nil {
 		// The API is a bit weird here, you are supposed to get an SFTP error
 		// (for lack of privileges etc) but if the transport layer fails you
 		// get no error here and you have to check the session level error.
@@ -182,17 +215,23 @@ func (ss *SftpSession) OpenFile(path string, flags OpenFlags, mode FileMode) (*S
 		}
 	}
 
-	return handle, nil
+	return &SftpFile{parent: ss, ptr: ptr}, nil
 }
 
 func (ss *SftpSession) OpenDir(path string, flags OpenFlags, mode FileMode) (*SftpDir, error) {
-	pathnameCStr := C.CString(path)
-	defer C.free(unsafe.Pointer(pathnameCStr))
+	return ss.OpenDirContext(context.Background(), path, flags, mode)
+}
+
+func (ss *SftpSession) OpenDirContext(ctx context.Context, path string, flags OpenFlags, mode FileMode) (*SftpDir, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
 
-	handle := &SftpDir{parent: ss}
-	handle.ptr = C.libssh2_sftp_open_ex(ss.ptr, pathnameCStr, C.uint(len(path)), C.ulong(flags), C.long(mode), C.LIBSSH2_SFTP_OPENDIR)
+	ptr, err := ss.open(ctx, path, flags, mode, C.LIBSSH2_SFTP_OPENDIR)
+	if err != nil {
+		return nil, err
+	}
 
-	if handle.ptr == nil {
+	if ptr == nil {
 		// ditto
 		if err := ss.GetLastError(); err != nil {
 			return nil, ss.GetLastError()
@@ -203,19 +242,52 @@ func (ss *SftpSession) OpenDir(path string, flags OpenFlags, mode FileMode) (*Sf
 		}
 	}
 
-	return handle, nil
+	return &SftpDir{parent: ss, ptr: ptr}, nil
+}
+
+// open returns a nil handle on failure, the error is only set when the
+// operation couldn't complete.
+func (ss *SftpSession) open(ctx context.Context, path string, flags OpenFlags, mode FileMode, openType C.int) (*C.LIBSSH2_SFTP_HANDLE, error) {
+	pathnameCStr := C.CString(path)
+	defer C.free(unsafe.Pointer(pathnameCStr))
+
+	var ptr *C.LIBSSH2_SFTP_HANDLE
+	err := ss.parent.do(ctx, "sftp open", func() C.int {
+		ptr = C.libssh2_sftp_open_ex(ss.ptr, pathnameCStr, C.uint(len(path)), C.ulong(flags), C.long(mode), openType)
+		if ptr == nil {
+			return onlyEagain(C.libssh2_session_last_errno(ss.parent.ptr))
+		}
+		return 0
+	})
+
+	return ptr, err
 }
 
 func (ss *SftpSession) Mkdir(path string, mode FileMode) error {
+	return ss.MkdirContext(context.Background(), path, mode)
+}
+
+func (ss *SftpSession) MkdirContext(ctx context.Context, path string, mode FileMode) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
 	pathnameCStr := C.CString(path)
 	defer C.free(unsafe.Pointer(pathnameCStr))
 
-	rc := C.libssh2_sftp_mkdir_ex(ss.ptr, pathnameCStr, C.uint(len(path)), C.long(mode))
+	var rc C.int
+	err := ss.parent.do(ctx, "sftp mkdir", func() C.int {
+		rc = C.libssh2_sftp_mkdir_ex(ss.ptr, pathnameCStr, C.uint(len(path)), C.long(mode))
+		return onlyEagain(rc)
+	})
+	if err != nil {
+		return err
+	}
+
 	if rc < 0 {
 		if err := ss.GetLastError(); err != nil {
 			return ss.GetLastError()
 		} else {
-			return wrapSshError(rc)
+			return newError("sftp mkdir", rc, "")
 		}
 	}
 
@@ -223,8 +295,12 @@ func (ss *SftpSession) Mkdir(path string, mode FileMode) error {
 }
 
 func (ss *SftpSession) MkdirAll(path string, perm FileMode) error {
+	return ss.MkdirAllContext(context.Background(), path, perm)
+}
+
+func (ss *SftpSession) MkdirAllContext(ctx context.Context, path string, perm FileMode) error {
 	// Fast path: if we can tell whether path is a directory or file, stop with success or error.
-	dir, err := ss.Stat(path)
+	dir, err := ss.StatContext(ctx, path)
 	if err == nil {
 		if dir.IsDir() {
 			return nil
@@ -251,18 +327,18 @@ func (ss *SftpSession) MkdirAll(path string, perm FileMode) error {
 	// If there is a parent directory, and it is not the volume name,
 	// recurse to ensure parent directory exists.
 	if parent := path[:i]; len(parent) > 0 {
-		err = ss.MkdirAll(parent, perm)
+		err = ss.MkdirAllContext(ctx, parent, perm)
 		if err != nil {
 			return err
 		}
 	}
 
 	// Parent now exists; invoke Mkdir and use its result.
-	err = ss.Mkdir(path, perm)
+	err = ss.MkdirContext(ctx, path, perm)
 	if err != nil {
 		// Handle arguments like "foo/." by
 		// double-checking that directory doesn't exist.
-		dir, err1 := ss.Lstat(path)
+		dir, err1 := ss.LstatContext(ctx, path)
 		if err1 == nil && dir.IsDir() {
 			return nil
 		}
@@ -272,20 +348,45 @@ func (ss *SftpSession) MkdirAll(path string, perm FileMode) error {
 }
 
 func (ss *SftpSession) Rmdir(path string) error {
+	return ss.RmdirContext(context.Background(), path)
+}
+
+func (ss *SftpSession) RmdirContext(ctx context.Context, path string) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
 	pathnameCStr := C.CString(path)
 	defer C.free(unsafe.Pointer(pathnameCStr))
 
-	return wrapSshError(C.libssh2_sftp_rmdir_ex(ss.ptr, pathnameCStr, C.uint(len(path))))
+	return ss.parent.do(ctx, "sftp rmdir", func() C.int {
+		return C.libssh2_sftp_rmdir_ex(ss.ptr, pathnameCStr, C.uint(len(path)))
+	})
 }
 
 func (ss *SftpSession) Unlink(path string) error {
+	return ss.UnlinkContext(context.Background(), path)
+}
+
+func (ss *SftpSession) UnlinkContext(ctx context.Context, path string) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
 	pathnameCStr := C.CString(path)
 	defer C.free(unsafe.Pointer(pathnameCStr))
 
-	return wrapSshError(C.libssh2_sftp_unlink_ex(ss.ptr, pathnameCStr, C.uint(len(path))))
+	return ss.parent.do(ctx, "sftp unlink", func() C.int {
+		return C.libssh2_sftp_unlink_ex(ss.ptr, pathnameCStr, C.uint(len(path)))
+	})
 }
 
 func (ss *SftpSession) Rename(oldname, newname string) error {
+	return ss.RenameContext(context.Background(), oldname, newname)
+}
+
+func (ss *SftpSession) RenameContext(ctx context.Context, oldname, newname string) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
 	oldnameCStr := C.CString(oldname)
 	defer C.free(unsafe.Pointer(oldnameCStr))
 	newnameCStr := C.CString(newname)
@@ -293,66 +394,81 @@ func (ss *SftpSession) Rename(oldname, newname string) error {
 
 	// Default behavior for rename, maybe we want RenameEx at some point but I'm not sure.
 	flags := C.LIBSSH2_SFTP_RENAME_OVERWRITE | C.LIBSSH2_SFTP_RENAME_ATOMIC | C.LIBSSH2_SFTP_RENAME_NATIVE
-	return wrapSshError(C.libssh2_sftp_rename_ex(ss.ptr, oldnameCStr, C.uint(len(oldname)), newnameCStr, C.uint(len(newname)), C.long(flags)))
+	return ss.parent.do(ctx, "sftp rename", func() C.int {
+		return C.libssh2_sftp_rename_ex(ss.ptr, oldnameCStr, C.uint(len(oldname)), newnameCStr, C.uint(len(newname)), C.long(flags))
+	})
 }
 
 func (ss *SftpSession) Stat(pathname string) (os.FileInfo, error) {
-	pathnameCStr := C.CString(pathname)
-	defer C.free(unsafe.Pointer(pathnameCStr))
+	return ss.StatContext(context.Background(), pathname)
+}
 
-	attrs := &C.LIBSSH2_SFTP_ATTRIBUTES{}
-	ret := C.libssh2_sftp_stat_ex(ss.ptr, pathnameCStr, C.uint(len(pathname)), C.LIBSSH2_SFTP_STAT, attrs)
-	if ret < 0 {
-		return nil, wrapSshError(ret)
+func (ss *SftpSession) StatContext(ctx context.Context, pathname string) (os.FileInfo, error) {
+	attrs, err := ss.stat(ctx, pathname, C.LIBSSH2_SFTP_STAT, &C.LIBSSH2_SFTP_ATTRIBUTES{})
+	if err != nil {
+		return nil, err
 	}
 
 	return &sftpFileInfo{name: path.Base(pathname), attrs: attrs}, nil
 }
 
 func (ss *SftpSession) Lstat(pathname string) (os.FileInfo, error) {
-	pathnameCStr := C.CString(pathname)
-	defer C.free(unsafe.Pointer(pathnameCStr))
+	return ss.LstatContext(context.Background(), pathname)
+}
 
-	attrs := &C.LIBSSH2_SFTP_ATTRIBUTES{}
-	ret := C.libssh2_sftp_stat_ex(ss.ptr, pathnameCStr, C.uint(len(pathname)), C.LIBSSH2_SFTP_LSTAT, attrs)
-	if ret < 0 {
-		return nil, wrapSshError(ret)
+func (ss *SftpSession) LstatContext(ctx context.Context, pathname string) (os.FileInfo, error) {
+	attrs, err := ss.stat(ctx, pathname, C.LIBSSH2_SFTP_LSTAT, &C.LIBSSH2_SFTP_ATTRIBUTES{})
+	if err != nil {
+		return nil, err
 	}
 
 	return &sftpFileInfo{name: path.Base(pathname), attrs: attrs}, nil
 }
 
 func (ss *SftpSession) Chown(pathname string, uid, gid int) error {
-	pathnameCStr := C.CString(pathname)
-	defer C.free(unsafe.Pointer(pathnameCStr))
+	return ss.ChownContext(context.Background(), pathname, uid, gid)
+}
 
+func (ss *SftpSession) ChownContext(ctx context.Context, pathname string, uid, gid int) error {
 	attrs := &C.LIBSSH2_SFTP_ATTRIBUTES{}
 	attrs.flags = C.LIBSSH2_SFTP_ATTR_UIDGID
 	attrs.uid = C.ulong(uid)
 	attrs.gid = C.ulong(gid)
 
-	ret := C.libssh2_sftp_stat_ex(ss.ptr, pathnameCStr, C.uint(len(pathname)), C.LIBSSH2_SFTP_SETSTAT, attrs)
-	if ret < 0 {
-		return wrapSshError(ret)
-	}
-
-	return nil
+	_, err := ss.stat(ctx, pathname, C.LIBSSH2_SFTP_SETSTAT, attrs)
+	return err
 }
 
 func (ss *SftpSession) Chmod(pathname string, mode os.FileMode) error {
-	pathnameCStr := C.CString(pathname)
-	defer C.free(unsafe.Pointer(pathnameCStr))
+	return ss.ChmodContext(context.Background(), pathname, mode)
+}
 
+func (ss *SftpSession) ChmodContext(ctx context.Context, pathname string, mode os.FileMode) error {
 	attrs := &C.LIBSSH2_SFTP_ATTRIBUTES{}
 	attrs.flags = C.LIBSSH2_SFTP_ATTR_PERMISSIONS
 	attrs.permissions = C.ulong(mode & os.ModePerm)
 
-	ret := C.libssh2_sftp_stat_ex(ss.ptr, pathnameCStr, C.uint(len(pathname)), C.LIBSSH2_SFTP_SETSTAT, attrs)
-	if ret < 0 {
-		return wrapSshError(ret)
+	_, err := ss.stat(ctx, pathname, C.LIBSSH2_SFTP_SETSTAT, attrs)
+	return err
+}
+
+// stat performs any of the stat_ex operations, attrs is both input (setstat)
+// and output.
+func (ss *SftpSession) stat(ctx context.Context, pathname string, statType C.int, attrs *C.LIBSSH2_SFTP_ATTRIBUTES) (*C.LIBSSH2_SFTP_ATTRIBUTES, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	pathnameCStr := C.CString(pathname)
+	defer C.free(unsafe.Pointer(pathnameCStr))
+
+	err := ss.parent.do(ctx, "sftp stat", func() C.int {
+		return C.libssh2_sftp_stat_ex(ss.ptr, pathnameCStr, C.uint(len(pathname)), statType, attrs)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	return attrs, nil
 }
 
 // Low level Setstat function, will only set w/e is present in the map.
@@ -385,7 +501,11 @@ func (ss *SftpSession) Setstat(pathname string, attrs map[StatAttrFlags]any) err
 
 /* Directory specific methods */
 func (ss *SftpSession) ReadDir(path string) ([]os.FileInfo, error) {
-	dirfp, err := ss.OpenDir(path, 0, 0)
+	return ss.ReadDirContext(context.Background(), path)
+}
+
+func (ss *SftpSession) ReadDirContext(ctx context.Context, path string) ([]os.FileInfo, error) {
+	dirfp, err := ss.OpenDirContext(ctx, path, 0, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -395,7 +515,18 @@ func (ss *SftpSession) ReadDir(path string) ([]os.FileInfo, error) {
 	buf := make([]byte, 512)
 	for {
 		attrs := &C.LIBSSH2_SFTP_ATTRIBUTES{}
-		ret := C.libssh2_sftp_readdir_ex(dirfp.ptr, (*C.char)(unsafe.Pointer(&buf[0])), C.size_t(512), nil, 0, attrs)
+
+		var ret C.int
+		ss.mu.Lock()
+		err := ss.parent.do(ctx, "sftp readdir", func() C.int {
+			ret = C.libssh2_sftp_readdir_ex(dirfp.ptr, (*C.char)(unsafe.Pointer(&buf[0])), C.size_t(512), nil, 0, attrs)
+			return onlyEagain(ret)
+		})
+		ss.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
 		if ret <= 0 {
 			break
 		}
@@ -414,30 +545,54 @@ func (ss *SftpSession) ReadDir(path string) ([]os.FileInfo, error) {
 }
 
 func (ss *SftpDir) Stat() (os.FileInfo, error) {
+	ss.parent.mu.Lock()
+	defer ss.parent.mu.Unlock()
+
 	attrs := &C.LIBSSH2_SFTP_ATTRIBUTES{}
-	ret := C.libssh2_sftp_fstat_ex(ss.ptr, attrs, 0)
-	if ret < 0 {
-		return nil, wrapSshError(ret)
+	err := ss.parent.parent.do(context.Background(), "sftp fstat", func() C.int {
+		return C.libssh2_sftp_fstat_ex(ss.ptr, attrs, 0)
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return &sftpFileInfo{name: path.Base(""), attrs: attrs}, nil
 }
 
 func (ss *SftpDir) Close() error {
-	return wrapSshError(C.libssh2_sftp_close_handle(ss.ptr))
+	ss.parent.mu.Lock()
+	defer ss.parent.mu.Unlock()
+
+	return ss.parent.parent.do(context.Background(), "sftp close", func() C.int {
+		return C.libssh2_sftp_close_handle(ss.ptr)
+	})
 }
 
 /* File specific methods */
 func (ss *SftpFile) Read(p []byte) (int, error) {
+	return ss.ReadContext(context.Background(), p)
+}
+
+func (ss *SftpFile) ReadContext(ctx context.Context, p []byte) (int, error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
 
+	ss.parent.mu.Lock()
+	defer ss.parent.mu.Unlock()
+
 	// The library doesn't hold a ref to the buffer so it's safe to just pass
 	// the pointer here it can't be garbage collected in between.
-	n := C.libssh2_sftp_read(ss.ptr, (*C.char)(unsafe.Pointer(&p[0])), C.size_t(len(p)))
-	if n < 0 {
-		return 0, wrapSshError(C.int(n))
+	var n C.ssize_t
+	err := ss.parent.parent.do(ctx, "sftp read", func() C.int {
+		n = C.libssh2_sftp_read(ss.ptr, (*C.char)(unsafe.Pointer(&p[0])), C.size_t(len(p)))
+		if n < 0 {
+			return C.int(n)
+		}
+		return 0
+	})
+	if err != nil {
+		return 0, err
 	} else if n == 0 {
 		return 0, io.EOF
 	} else {
@@ -446,32 +601,55 @@ func (ss *SftpFile) Read(p []byte) (int, error) {
 }
 
 func (ss *SftpFile) Write(p []byte) (int, error) {
+	return ss.WriteContext(context.Background(), p)
+}
+
+func (ss *SftpFile) WriteContext(ctx context.Context, p []byte) (int, error) {
+	ss.parent.mu.Lock()
+	defer ss.parent.mu.Unlock()
+
 	// XXX Review int types in here.
 	var written int = 0
 	for written < len(p) {
 		leftover := len(p) - written
-		n := int(C.libssh2_sftp_write(ss.ptr, (*C.char)(unsafe.Pointer(&p[written])), C.size_t(leftover)))
-		if n < 0 {
-			return n, wrapSshError(C.int(n))
+
+		var n C.ssize_t
+		err := ss.parent.parent.do(ctx, "sftp write", func() C.int {
+			n = C.libssh2_sftp_write(ss.ptr, (*C.char)(unsafe.Pointer(&p[written])), C.size_t(leftover))
+			if n < 0 {
+				return C.int(n)
+			}
+			return 0
+		})
+		if err != nil {
+			return written, err
 		}
 
-		written += n
+		written += int(n)
 	}
 
 	return written, nil
 }
 
 func (ss *SftpFile) Stat() (os.FileInfo, error) {
+	ss.parent.mu.Lock()
+	defer ss.parent.mu.Unlock()
+
 	attrs := &C.LIBSSH2_SFTP_ATTRIBUTES{}
-	ret := C.libssh2_sftp_fstat_ex(ss.ptr, attrs, 0)
-	if ret < 0 {
-		return nil, wrapSshError(ret)
+	err := ss.parent.parent.do(context.Background(), "sftp fstat", func() C.int {
+		return C.libssh2_sftp_fstat_ex(ss.ptr, attrs, 0)
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return &sftpFileInfo{name: path.Base(""), attrs: attrs}, nil
 }
 
 func (ss *SftpFile) Seek(offset int64) {
+	ss.parent.mu.Lock()
+	defer ss.parent.mu.Unlock()
+
 	C.libssh2_sftp_seek64(ss.ptr, C.libssh2_uint64_t(offset))
 }
 
@@ -480,9 +658,17 @@ func (ss *SftpFile) Rewind() {
 }
 
 func (ss *SftpFile) Tell() int64 {
+	ss.parent.mu.Lock()
+	defer ss.parent.mu.Unlock()
+
 	return int64(C.libssh2_sftp_tell64(ss.ptr))
 }
 
 func (ss *SftpFile) Close() error {
-	return wrapSshError(C.libssh2_sftp_close_handle(ss.ptr))
+	ss.parent.mu.Lock()
+	defer ss.parent.mu.Unlock()
+
+	return ss.parent.parent.do(context.Background(), "sftp close", func() C.int {
+		return C.libssh2_sftp_close_handle(ss.ptr)
+	})
 }
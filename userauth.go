@@ -3,10 +3,17 @@ package ssh2
 /*
 #include <libssh2.h>
 #include <stdlib.h>
+
+extern void goKbdintResponse(char *, int, char *, int, int, LIBSSH2_USERAUTH_KBDINT_PROMPT *,
+	LIBSSH2_USERAUTH_KBDINT_RESPONSE *, void **);
+extern void goPasswordChange(LIBSSH2_SESSION *, char **, int *, void **);
+extern int goSign(LIBSSH2_SESSION *, unsigned char **, size_t *, unsigned char *, size_t, void **);
 */
 import "C"
 
 import (
+	"context"
+	"crypto"
 	"fmt"
 	"unsafe"
 )
@@ -14,10 +21,24 @@ import (
 // UserAuthList gets the remote's list of supported authentication methods
 // It returns the list as a comma separated value
 func (ss *SshSession) UserAuthList(username string) (string, error) {
+	return ss.UserAuthListContext(context.Background(), username)
+}
+
+func (ss *SshSession) UserAuthListContext(ctx context.Context, username string) (string, error) {
 	usernameCStr := C.CString(username)
 	defer C.free(unsafe.Pointer(usernameCStr))
 
-	digestCstr := C.libssh2_userauth_list(ss.ptr, usernameCStr, C.uint(len(username)))
+	var digestCstr *C.char
+	err := ss.do(ctx, "userauth list", func() C.int {
+		digestCstr = C.libssh2_userauth_list(ss.ptr, usernameCStr, C.uint(len(username)))
+		if digestCstr == nil && C.libssh2_userauth_authenticated(ss.ptr) == 0 {
+			return C.libssh2_session_last_errno(ss.ptr)
+		}
+		return 0
+	})
+	if err != nil {
+		return "", err
+	}
 
 	if digestCstr == nil {
 		return "", fmt.Errorf("failed to list remote's supported authentication methods")
@@ -26,14 +47,315 @@ func (ss *SshSession) UserAuthList(username string) (string, error) {
 	return C.GoString(digestCstr), nil
 }
 
+// UserAuthBanner returns the message the server displays before
+// authentication, typically a legal notice. It's received along with the
+// first authentication attempt, UserAuthList included, and is empty if the
+// server has none.
+func (ss *SshSession) UserAuthBanner() (string, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	var bannerCStr *C.char
+	rc := C.libssh2_userauth_banner(ss.ptr, &bannerCStr)
+	if rc == C.LIBSSH2_ERROR_MISSING_USERAUTH_BANNER {
+		return "", nil
+	} else if rc < 0 {
+		return "", newError("userauth banner", rc, ss.lastMessage(rc))
+	}
+
+	return C.GoString(bannerCStr), nil
+}
+
 // UserAuthPassword auth the user with the given password.
 // This function may return ErrorEagain in case it would block
 func (ss *SshSession) UserAuthPassword(username, password string) error {
+	return ss.UserAuthPasswordContext(context.Background(), username, password)
+}
+
+func (ss *SshSession) UserAuthPasswordContext(ctx context.Context, username, password string) error {
+	return ss.UserAuthPasswordChangeContext(ctx, username, password, nil)
+}
+
+// PasswordChangeCallback supplies a new password when the server says the
+// current one expired. It runs within the authentication call and must not
+// use the session.
+type PasswordChangeCallback func() (string, error)
+
+type passwordChangeCall struct {
+	newPassword PasswordChangeCallback
+	err         error
+}
+
+// UserAuthPasswordChange is like UserAuthPassword, but when the password
+// expired newPassword is asked for a replacement, which is sent to the
+// server, instead of failing with ErrorPasswordExpired. newPassword can be
+// nil.
+func (ss *SshSession) UserAuthPasswordChange(username, password string, newPassword PasswordChangeCallback) error {
+	return ss.UserAuthPasswordChangeContext(context.Background(), username, password, newPassword)
+}
+
+func (ss *SshSession) UserAuthPasswordChangeContext(ctx context.Context, username, password string, newPassword PasswordChangeCallback) error {
 	usernameCStr := C.CString(username)
 	defer C.free(unsafe.Pointer(usernameCStr))
 
 	passwordCStr := C.CString(password)
 	defer C.free(unsafe.Pointer(passwordCStr))
 
-	return wrapSshError(C.libssh2_userauth_password_ex(ss.ptr, usernameCStr, C.uint(len(username)), passwordCStr, C.uint(len(password)), nil))
+	var changeFn *[0]byte
+	pc := &passwordChangeCall{newPassword: newPassword}
+	if newPassword != nil {
+		changeFn = (*[0]byte)(C.goPasswordChange)
+	}
+
+	err := ss.do(ctx, "userauth password", func() C.int {
+		ss.passwordChange = pc
+		defer func() { ss.passwordChange = nil }()
+
+		return C.libssh2_userauth_password_ex(ss.ptr, usernameCStr, C.uint(len(username)), passwordCStr, C.uint(len(password)), changeFn)
+	})
+
+	if pc.err != nil {
+		return pc.err
+	}
+
+	return err
+}
+
+// UserAuthPublicKeyFromFile authenticates with the private key at
+// privateKeyPath, decrypted with passphrase if it's protected. Both PEM and
+// OpenSSH formats are supported. publicKeyPath can be empty, in which case
+// the public key is derived from the private one.
+func (ss *SshSession) UserAuthPublicKeyFromFile(username, publicKeyPath, privateKeyPath, passphrase string) error {
+	return ss.UserAuthPublicKeyFromFileContext(context.Background(), username, publicKeyPath, privateKeyPath, passphrase)
+}
+
+func (ss *SshSession) UserAuthPublicKeyFromFileContext(ctx context.Context, username, publicKeyPath, privateKeyPath, passphrase string) error {
+	usernameCStr := C.CString(username)
+	defer C.free(unsafe.Pointer(usernameCStr))
+
+	var publicKeyCStr *C.char
+	if publicKeyPath != "" {
+		publicKeyCStr = C.CString(publicKeyPath)
+		defer C.free(unsafe.Pointer(publicKeyCStr))
+	}
+
+	privateKeyCStr := C.CString(privateKeyPath)
+	defer C.free(unsafe.Pointer(privateKeyCStr))
+
+	passphraseCStr := C.CString(passphrase)
+	defer C.free(unsafe.Pointer(passphraseCStr))
+
+	return ss.do(ctx, "userauth publickey", func() C.int {
+		return C.libssh2_userauth_publickey_fromfile_ex(ss.ptr, usernameCStr, C.uint(len(username)),
+			publicKeyCStr, privateKeyCStr, passphraseCStr)
+	})
+}
+
+// UserAuthPublicKeyFromMemory is like UserAuthPublicKeyFromFile with the
+// keys' content, as read from the files. publicKey can be nil.
+func (ss *SshSession) UserAuthPublicKeyFromMemory(username string, publicKey, privateKey []byte, passphrase string) error {
+	return ss.UserAuthPublicKeyFromMemoryContext(context.Background(), username, publicKey, privateKey, passphrase)
+}
+
+func (ss *SshSession) UserAuthPublicKeyFromMemoryContext(ctx context.Context, username string, publicKey, privateKey []byte, passphrase string) error {
+	usernameCStr := C.CString(username)
+	defer C.free(unsafe.Pointer(usernameCStr))
+
+	var publicKeyCStr *C.char
+	if len(publicKey) > 0 {
+		publicKeyCStr = (*C.char)(C.CBytes(publicKey))
+		defer C.free(unsafe.Pointer(publicKeyCStr))
+	}
+
+	// Copied so it can be wiped, it's key material.
+	privateKeyCStr := (*C.char)(C.CBytes(privateKey))
+	defer C.free(unsafe.Pointer(privateKeyCStr))
+	defer clear(unsafe.Slice((*byte)(unsafe.Pointer(privateKeyCStr)), len(privateKey)))
+
+	passphraseCStr := C.CString(passphrase)
+	defer C.free(unsafe.Pointer(passphraseCStr))
+
+	return ss.do(ctx, "userauth publickey", func() C.int {
+		return C.libssh2_userauth_publickey_frommemory(ss.ptr, usernameCStr, C.size_t(len(username)),
+			publicKeyCStr, C.size_t(len(publicKey)), privateKeyCStr, C.size_t(len(privateKey)), passphraseCStr)
+	})
+}
+
+// Prompt is a question asked during keyboard-interactive authentication,
+// Echo tells whether the answer may be displayed as it's typed.
+type Prompt struct {
+	Text string
+	Echo bool
+}
+
+// KeyboardInteractiveChallenge answers the prompts of a keyboard-interactive
+// round, with one answer per prompt. The server may ask several rounds, name
+// and instruction being optional. It runs within the authentication call and
+// must not use the session.
+type KeyboardInteractiveChallenge func(name, instruction string, prompts []Prompt) ([]string, error)
+
+type kbdintCall struct {
+	challenge KeyboardInteractiveChallenge
+	err       error
+}
+
+func (kc *kbdintCall) respond(name, instruction string, cprompts []C.LIBSSH2_USERAUTH_KBDINT_PROMPT, responses []C.LIBSSH2_USERAUTH_KBDINT_RESPONSE) {
+	if kc.err != nil {
+		return
+	}
+
+	prompts := make([]Prompt, len(cprompts))
+	for i, p := range cprompts {
+		prompts[i] = Prompt{
+			Text: C.GoStringN((*C.char)(unsafe.Pointer(p.text)), C.int(p.length)),
+			Echo: p.echo != 0,
+		}
+	}
+
+	answers, err := kc.challenge(name, instruction, prompts)
+	if err == nil && len(answers) != len(prompts) {
+		err = fmt.Errorf("got %d answers to %d prompts", len(answers), len(prompts))
+	}
+
+	// Without answers libssh2 sends empty ones, which the server rejects.
+	if err != nil {
+		kc.err = err
+		return
+	}
+
+	// libssh2 frees them.
+	for i, answer := range answers {
+		responses[i].text = C.CString(answer)
+		responses[i].length = C.uint(len(answer))
+	}
+}
+
+// UserAuthKeyboardInteractive authenticates by answering the server's
+// prompts with challenge.
+func (ss *SshSession) UserAuthKeyboardInteractive(username string, challenge KeyboardInteractiveChallenge) error {
+	return ss.UserAuthKeyboardInteractiveContext(context.Background(), username, challenge)
+}
+
+func (ss *SshSession) UserAuthKeyboardInteractiveContext(ctx context.Context, username string, challenge KeyboardInteractiveChallenge) error {
+	usernameCStr := C.CString(username)
+	defer C.free(unsafe.Pointer(usernameCStr))
+
+	kc := &kbdintCall{challenge: challenge}
+	err := ss.do(ctx, "userauth keyboard-interactive", func() C.int {
+		ss.kbdint = kc
+		defer func() { ss.kbdint = nil }()
+
+		return C.libssh2_userauth_keyboard_interactive_ex(ss.ptr, usernameCStr, C.uint(len(username)),
+			(*[0]byte)(C.goKbdintResponse))
+	})
+
+	if kc.err != nil {
+		return kc.err
+	}
+
+	return err
+}
+
+type signCall struct {
+	signer crypto.Signer
+	err    error
+}
+
+// sign signs the authentication request in data, whose algorithm tells
+// which hash RSA keys must use.
+func (sc *signCall) sign(data []byte) ([]byte, error) {
+	// string session id, byte request, string user, string service,
+	// string "publickey", bool true, string algorithm, see RFC 4252.
+	var algo []byte
+	rest, ok := data, true
+	for _, field := range "sbsssbs" {
+		if !ok {
+			break
+		}
+
+		switch field {
+		case 'b':
+			ok = len(rest) > 0
+			if ok {
+				rest = rest[1:]
+			}
+		case 's':
+			algo, rest, ok = readString(rest)
+		}
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("malformed publickey authentication request")
+	}
+
+	return sign(sc.signer, string(algo), data)
+}
+
+// UserAuthPublicKeySigner authenticates with the key behind signer, which
+// can live anywhere: in memory, in an HSM... RSA, ECDSA and Ed25519 keys
+// are supported.
+func (ss *SshSession) UserAuthPublicKeySigner(username string, signer crypto.Signer) error {
+	return ss.UserAuthPublicKeySignerContext(context.Background(), username, signer)
+}
+
+func (ss *SshSession) UserAuthPublicKeySignerContext(ctx context.Context, username string, signer crypto.Signer) error {
+	pub, _, err := marshalPublicKey(signer.Public())
+	if err != nil {
+		return err
+	}
+
+	usernameCStr := C.CString(username)
+	defer C.free(unsafe.Pointer(usernameCStr))
+
+	pubCStr := C.CBytes(pub)
+	defer C.free(pubCStr)
+
+	sc := &signCall{signer: signer}
+	err = ss.do(ctx, "userauth publickey", func() C.int {
+		ss.signer = sc
+		defer func() { ss.signer = nil }()
+
+		return C.libssh2_userauth_publickey(ss.ptr, usernameCStr, (*C.uchar)(pubCStr), C.size_t(len(pub)),
+			(*[0]byte)(C.goSign), nil)
+	})
+
+	if sc.err != nil {
+		return sc.err
+	}
+
+	return err
+}
+
+// UserAuthHostbasedFromFile authenticates username as localUsername on
+// hostname, the local host, using the host key pair at publicKeyPath and
+// privateKeyPath. The server must trust the host, e.g. through
+// shosts.equiv.
+func (ss *SshSession) UserAuthHostbasedFromFile(username, publicKeyPath, privateKeyPath, passphrase, hostname, localUsername string) error {
+	return ss.UserAuthHostbasedFromFileContext(context.Background(), username, publicKeyPath, privateKeyPath, passphrase, hostname, localUsername)
+}
+
+func (ss *SshSession) UserAuthHostbasedFromFileContext(ctx context.Context, username, publicKeyPath, privateKeyPath, passphrase, hostname, localUsername string) error {
+	usernameCStr := C.CString(username)
+	defer C.free(unsafe.Pointer(usernameCStr))
+
+	publicKeyCStr := C.CString(publicKeyPath)
+	defer C.free(unsafe.Pointer(publicKeyCStr))
+
+	privateKeyCStr := C.CString(privateKeyPath)
+	defer C.free(unsafe.Pointer(privateKeyCStr))
+
+	passphraseCStr := C.CString(passphrase)
+	defer C.free(unsafe.Pointer(passphraseCStr))
+
+	hostnameCStr := C.CString(hostname)
+	defer C.free(unsafe.Pointer(hostnameCStr))
+
+	localUsernameCStr := C.CString(localUsername)
+	defer C.free(unsafe.Pointer(localUsernameCStr))
+
+	return ss.do(ctx, "userauth hostbased", func() C.int {
+		return C.libssh2_userauth_hostbased_fromfile_ex(ss.ptr, usernameCStr, C.uint(len(username)),
+			publicKeyCStr, privateKeyCStr, passphraseCStr,
+			hostnameCStr, C.uint(len(hostname)), localUsernameCStr, C.uint(len(localUsername)))
+	})
 }
@@ -0,0 +1,224 @@
+package ssh2
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+)
+
+// Just enough of the SSH wire format (RFC 4251) to handle keys and
+// signatures, the package itself doesn't use golang.org/x/crypto. Only its
+// tests do, to have an SSH server to talk to.
+
+func appendString(b []byte, s []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func appendMpint(b []byte, n *big.Int) []byte {
+	if n.Sign() == 0 {
+		return appendString(b, nil)
+	}
+
+	// Positive numbers with the high bit set need a leading zero.
+	mag := n.Bytes()
+	if mag[0]&0x80 != 0 {
+		mag = append([]byte{0}, mag...)
+	}
+
+	return appendString(b, mag)
+}
+
+// readString splits the string at the start of b from the rest.
+func readString(b []byte) ([]byte, []byte, bool) {
+	if len(b) < 4 {
+		return nil, nil, false
+	}
+
+	n := binary.BigEndian.Uint32(b)
+	if uint64(len(b)-4) < uint64(n) {
+		return nil, nil, false
+	}
+
+	return b[4 : 4+n], b[4+n:], true
+}
+
+// readMpint is readString for a non-negative mpint.
+func readMpint(b []byte) (*big.Int, []byte, bool) {
+	mag, rest, ok := readString(b)
+	if !ok || len(mag) > 0 && mag[0]&0x80 != 0 {
+		return nil, nil, false
+	}
+
+	return new(big.Int).SetBytes(mag), rest, true
+}
+
+// curveName returns the SSH name of an ECDSA curve and the hash its
+// signatures use.
+func curveName(curve elliptic.Curve) (string, crypto.Hash, error) {
+	switch curve {
+	case elliptic.P256():
+		return "nistp256", crypto.SHA256, nil
+	case elliptic.P384():
+		return "nistp384", crypto.SHA384, nil
+	case elliptic.P521():
+		return "nistp521", crypto.SHA512, nil
+	default:
+		return "", 0, fmt.Errorf("unsupported curve %s", curve.Params().Name)
+	}
+}
+
+// marshalPublicKey returns the SSH encoding of pub and its key type.
+func marshalPublicKey(pub crypto.PublicKey) ([]byte, string, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		b := appendString(nil, []byte("ssh-rsa"))
+		b = appendMpint(b, big.NewInt(int64(pub.E)))
+		b = appendMpint(b, pub.N)
+		return b, "ssh-rsa", nil
+
+	case *ecdsa.PublicKey:
+		curve, _, err := curveName(pub.Curve)
+		if err != nil {
+			return nil, "", err
+		}
+
+		ecdhPub, err := pub.ECDH()
+		if err != nil {
+			return nil, "", err
+		}
+		point := ecdhPub.Bytes()
+
+		keyType := "ecdsa-sha2-" + curve
+		b := appendString(nil, []byte(keyType))
+		b = appendString(b, []byte(curve))
+		b = appendString(b, point)
+		return b, keyType, nil
+
+	case ed25519.PublicKey:
+		b := appendString(nil, []byte("ssh-ed25519"))
+		b = appendString(b, pub)
+		return b, "ssh-ed25519", nil
+
+	default:
+		return nil, "", fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// parsePublicKey is the reverse of marshalPublicKey.
+func parsePublicKey(blob []byte) (crypto.PublicKey, error) {
+	keyType, rest, ok := readString(blob)
+	if !ok {
+		return nil, fmt.Errorf("malformed public key")
+	}
+
+	switch string(keyType) {
+	case "ssh-rsa":
+		e, rest, ok := readMpint(rest)
+		if !ok || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("malformed RSA public key")
+		}
+
+		n, _, ok := readMpint(rest)
+		if !ok {
+			return nil, fmt.Errorf("malformed RSA public key")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521":
+		_, rest, ok := readString(rest)
+		if !ok {
+			return nil, fmt.Errorf("malformed ECDSA public key")
+		}
+
+		point, _, ok := readString(rest)
+		if !ok {
+			return nil, fmt.Errorf("malformed ECDSA public key")
+		}
+
+		var curve elliptic.Curve
+		switch string(keyType) {
+		case "ecdsa-sha2-nistp256":
+			curve = elliptic.P256()
+		case "ecdsa-sha2-nistp384":
+			curve = elliptic.P384()
+		default:
+			curve = elliptic.P521()
+		}
+
+		x, y := elliptic.Unmarshal(curve, point)
+		if x == nil {
+			return nil, fmt.Errorf("malformed ECDSA public key")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "ssh-ed25519":
+		key, _, ok := readString(rest)
+		if !ok || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("malformed Ed25519 public key")
+		}
+
+		return ed25519.PublicKey(key), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported public key type %q", keyType)
+	}
+}
+
+// sign signs data with signer for the SSH signature algorithm algo, and
+// returns the signature blob without the algorithm name around it.
+func sign(signer crypto.Signer, algo string, data []byte) ([]byte, error) {
+	switch pub := signer.Public().(type) {
+	case *rsa.PublicKey:
+		var hash crypto.Hash
+		switch algo {
+		case "ssh-rsa":
+			hash = crypto.SHA1
+		case "rsa-sha2-256":
+			hash = crypto.SHA256
+		case "rsa-sha2-512":
+			hash = crypto.SHA512
+		default:
+			return nil, fmt.Errorf("unsupported signature algorithm %q for an RSA key", algo)
+		}
+
+		h := hash.New()
+		h.Write(data)
+		return signer.Sign(rand.Reader, h.Sum(nil), hash)
+
+	case *ecdsa.PublicKey:
+		_, hash, err := curveName(pub.Curve)
+		if err != nil {
+			return nil, err
+		}
+
+		h := hash.New()
+		h.Write(data)
+		der, err := signer.Sign(rand.Reader, h.Sum(nil), hash)
+		if err != nil {
+			return nil, err
+		}
+
+		var sig struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(der, &sig); err != nil {
+			return nil, err
+		}
+
+		return appendMpint(appendMpint(nil, sig.R), sig.S), nil
+
+	case ed25519.PublicKey:
+		return signer.Sign(rand.Reader, data, crypto.Hash(0))
+
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
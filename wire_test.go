@@ -0,0 +1,177 @@
+package ssh2
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"math/big"
+	"testing"
+)
+
+// testSigners returns one key of each supported type, by SSH key type.
+func testSigners(t *testing.T) map[string]crypto.Signer {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signers := map[string]crypto.Signer{"ssh-rsa": rsaKey}
+	for name, curve := range map[string]elliptic.Curve{
+		"ecdsa-sha2-nistp256": elliptic.P256(),
+		"ecdsa-sha2-nistp384": elliptic.P384(),
+		"ecdsa-sha2-nistp521": elliptic.P521(),
+	} {
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers[name] = key
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signers["ssh-ed25519"] = edKey
+
+	return signers
+}
+
+// verify checks sig, a signature blob without the algorithm name around it,
+// of data by pub for the signature algorithm algo.
+func verify(pub crypto.PublicKey, algo string, data, sig []byte) error {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		hash := map[string]crypto.Hash{
+			"ssh-rsa":      crypto.SHA1,
+			"rsa-sha2-256": crypto.SHA256,
+			"rsa-sha2-512": crypto.SHA512,
+		}[algo]
+		if hash == 0 {
+			return fmt.Errorf("unexpected algorithm %q for an RSA key", algo)
+		}
+
+		h := hash.New()
+		h.Write(data)
+		return rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), sig)
+
+	case *ecdsa.PublicKey:
+		_, hash, err := curveName(pub.Curve)
+		if err != nil {
+			return err
+		}
+
+		r, rest, ok := readString(sig)
+		if !ok {
+			return fmt.Errorf("malformed ECDSA signature")
+		}
+		s, _, ok := readString(rest)
+		if !ok {
+			return fmt.Errorf("malformed ECDSA signature")
+		}
+
+		h := hash.New()
+		h.Write(data)
+		if !ecdsa.Verify(pub, h.Sum(nil), new(big.Int).SetBytes(r), new(big.Int).SetBytes(s)) {
+			return fmt.Errorf("invalid ECDSA signature")
+		}
+		return nil
+
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, data, sig) {
+			return fmt.Errorf("invalid Ed25519 signature")
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unexpected public key type %T", pub)
+	}
+}
+
+func TestMarshalPublicKey(t *testing.T) {
+	for keyType, signer := range testSigners(t) {
+		blob, gotType, err := marshalPublicKey(signer.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if gotType != keyType {
+			t.Errorf("key type = %q, want %q", gotType, keyType)
+		}
+
+		if name, _, _ := readString(blob); string(name) != keyType {
+			t.Errorf("blob key type = %q, want %q", name, keyType)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	data := []byte("backup manifest")
+
+	for keyType, signer := range testSigners(t) {
+		algos := []string{keyType}
+		if keyType == "ssh-rsa" {
+			algos = append(algos, "rsa-sha2-256", "rsa-sha2-512")
+		}
+
+		for _, algo := range algos {
+			t.Run(algo, func(t *testing.T) {
+				sig, err := sign(signer, algo, data)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if err := verify(signer.Public(), algo, data, sig); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+	}
+}
+
+func TestSignUnsupportedAlgorithm(t *testing.T) {
+	signer := testSigners(t)["ssh-rsa"]
+	if _, err := sign(signer, "rsa-sha2-384", nil); err == nil {
+		t.Error("signing with rsa-sha2-384 succeeded")
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	for keyType, signer := range testSigners(t) {
+		t.Run(keyType, func(t *testing.T) {
+			blob, _, err := marshalPublicKey(signer.Public())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pub, err := parsePublicKey(blob)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+			if !want.Equal(pub) {
+				t.Errorf("parsed key differs from the original")
+			}
+
+			for n := range len(blob) - 1 {
+				if _, err := parsePublicKey(blob[:n]); err == nil {
+					t.Errorf("parsing the first %d bytes of the blob succeeded", n)
+				}
+			}
+		})
+	}
+}
+
+func TestParsePublicKeyUnsupported(t *testing.T) {
+	blob := appendString(nil, []byte("ssh-dss"))
+	if _, err := parsePublicKey(blob); err == nil {
+		t.Error("parsing a DSA key succeeded")
+	}
+}